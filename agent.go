@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freman/sshcode/authmethod"
+	"github.com/spf13/viper"
+)
+
+// agentOptions sets up which agent keys come from and go to, following
+// OpenSSH's IdentityAgent and AddKeysToAgent.
+func agentOptions() error {
+	switch identityAgent := viper.GetString("identityagent"); identityAgent {
+	case "", "SSH_AUTH_SOCK":
+	case "none":
+		authmethod.UseSystemAgent = false
+	default:
+		os.Setenv("SSH_AUTH_SOCK", expandHome(os.ExpandEnv(identityAgent)))
+	}
+
+	spec := viper.GetString("addkeystoagent")
+	addKeys, err := addKeysToAgent(spec)
+	if err != nil {
+		return err
+	}
+
+	// Forwarding without a system agent would offer the server an empty
+	// built-in one, so unless told otherwise it gets the identities we decrypt
+	if spec == "" && viper.GetBool("forwardagent") && authmethod.SystemAgent() == nil {
+		addKeys = &authmethod.AddKeys{}
+	}
+
+	authmethod.AddKeysToAgent = addKeys
+	return nil
+}
+
+// addKeysToAgent parses an AddKeysToAgent value: yes, no, confirm or ask,
+// optionally followed by how long the key is kept, which on its own implies
+// yes.
+func addKeysToAgent(spec string) (*authmethod.AddKeys, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+	if len(fields) == 0 || fields[0] == "no" {
+		return nil, nil
+	}
+
+	addKeys := &authmethod.AddKeys{}
+	switch fields[0] {
+	case "yes":
+	case "confirm":
+		addKeys.Confirm = true
+	case "ask":
+		addKeys.Ask = true
+	default:
+		fields = append([]string{"yes"}, fields...)
+	}
+
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unsupported AddKeysToAgent %q", spec)
+	}
+
+	if len(fields) == 2 {
+		lifetime, err := parseLifetime(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("unsupported AddKeysToAgent %q, expected one of yes, confirm, ask or no optionally followed by a time: %v", spec, err)
+		}
+		addKeys.Lifetime = lifetime
+	}
+
+	return addKeys, nil
+}
+
+// parseLifetime reads a time as plain seconds or a duration such as 1h30m.
+func parseLifetime(val string) (time.Duration, error) {
+	if secs, err := strconv.ParseUint(val, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+
+	lifetime, err := time.ParseDuration(val)
+	if err == nil && lifetime < time.Second {
+		err = fmt.Errorf("time %s is too short", val)
+	}
+	return lifetime, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/authmethod"
+	"github.com/spf13/viper"
+)
+
+func TestAgentOptionsForwarding(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Reset()
+		authmethod.UseSystemAgent = true
+		authmethod.AddKeysToAgent = nil
+	})
+
+	tests := []struct {
+		name    string
+		set     map[string]interface{}
+		addKeys *authmethod.AddKeys
+	}{
+		{
+			name: "not forwarding",
+			set:  map[string]interface{}{"identityagent": "none"},
+		},
+		{
+			name:    "forwarding without an agent",
+			set:     map[string]interface{}{"identityagent": "none", "forwardagent": true},
+			addKeys: &authmethod.AddKeys{},
+		},
+		{
+			name: "forwarding without adding keys",
+			set:  map[string]interface{}{"identityagent": "none", "forwardagent": true, "addkeystoagent": "no"},
+		},
+		{
+			name:    "forwarding with a lifetime",
+			set:     map[string]interface{}{"identityagent": "none", "forwardagent": true, "addkeystoagent": "confirm 1h"},
+			addKeys: &authmethod.AddKeys{Confirm: true, Lifetime: time.Hour},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Reset()
+			for key, val := range test.set {
+				viper.Set(key, val)
+			}
+
+			if err := agentOptions(); err != nil {
+				t.Fatal(err)
+			}
+
+			addKeys := authmethod.AddKeysToAgent
+			if (addKeys == nil) != (test.addKeys == nil) || addKeys != nil && *addKeys != *test.addKeys {
+				t.Errorf("expected keys to be added with %+v, got %+v", test.addKeys, addKeys)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// algorithmList resolves an OpenSSH style algorithm list against defaults. A
+// list starting with + is appended to the defaults, one starting with - is
+// removed from them and one starting with ^ is moved to the front, anything
+// else replaces the defaults entirely. Lists to remove may contain wildcards.
+func algorithmList(kind, spec string, defaults, supported []string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	modifier := spec[0]
+	switch modifier {
+	case '+', '-', '^':
+		spec = spec[1:]
+	default:
+		modifier = 0
+	}
+
+	names := strings.Split(spec, ",")
+	for _, name := range names {
+		if modifier == '-' {
+			continue
+		}
+		if !containsString(supported, name) {
+			return nil, fmt.Errorf("unsupported %s %q, expected one of %s", kind, name, strings.Join(supported, ", "))
+		}
+	}
+
+	var list []string
+	switch modifier {
+	case '+':
+		list = append(list, defaults...)
+		for _, name := range names {
+			if !containsString(list, name) {
+				list = append(list, name)
+			}
+		}
+	case '-':
+		for _, name := range defaults {
+			if !matchAnyWildcard(names, name) {
+				list = append(list, name)
+			}
+		}
+	case '^':
+		list = append(list, names...)
+		for _, name := range defaults {
+			if !containsString(names, name) {
+				list = append(list, name)
+			}
+		}
+	default:
+		list = names
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no %s algorithms left after applying %q", kind, spec)
+	}
+
+	return list, nil
+}
+
+// securityKeyHostKeyAlgorithms are in OpenSSH's default HostKeyAlgorithms
+// but can't be negotiated by golang.org/x/crypto/ssh.
+var securityKeyHostKeyAlgorithms = []string{
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.CertAlgoSKED25519v01,
+	ssh.CertAlgoSKECDSA256v01,
+}
+
+// withoutSecurityKeys drops security key algorithms from an algorithm list so
+// lists copied from OpenSSH still work, unless nothing else would be left.
+func withoutSecurityKeys(spec string) string {
+	if spec == "" {
+		return spec
+	}
+
+	var modifier string
+	if strings.ContainsAny(spec[:1], "+-^") {
+		modifier, spec = spec[:1], spec[1:]
+	}
+
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		if !containsString(securityKeyHostKeyAlgorithms, name) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return modifier + spec
+	}
+	return modifier + strings.Join(names, ",")
+}
+
+// matchAnyWildcard reports whether s matches any of patterns, which may hold *
+// and ? wildcards.
+func matchAnyWildcard(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if wildcardMatch(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sshAlgorithms returns the ciphers, key exchanges and MACs along with the
+// host key algorithms configured for the connection, leaving any that aren't
+// configured to the library defaults. SupportedAlgorithms and
+// InsecureAlgorithms need a golang.org/x/crypto newer than v0.31.0.
+func sshAlgorithms() (config ssh.Config, hostKeyAlgorithms []string, err error) {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+
+	if config.Ciphers, err = algorithmList("cipher", viper.GetString("ciphers"), supported.Ciphers, append(supported.Ciphers, insecure.Ciphers...)); err != nil {
+		return config, nil, err
+	}
+
+	if config.KeyExchanges, err = algorithmList("key exchange", viper.GetString("kexalgorithms"), supported.KeyExchanges, append(supported.KeyExchanges, insecure.KeyExchanges...)); err != nil {
+		return config, nil, err
+	}
+
+	if config.MACs, err = algorithmList("MAC", viper.GetString("macs"), supported.MACs, append(supported.MACs, insecure.MACs...)); err != nil {
+		return config, nil, err
+	}
+
+	hostKeyAlgorithms, err = algorithmList("host key", withoutSecurityKeys(viper.GetString("hostkeyalgorithms")), supported.HostKeys, append(supported.HostKeys, insecure.HostKeys...))
+	return config, hostKeyAlgorithms, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAlgorithmList(t *testing.T) {
+	defaults := []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"}
+	supported := append(defaults, "chacha20-poly1305@openssh.com", "aes128-cbc", "3des-cbc")
+
+	tests := []struct {
+		spec string
+		want []string
+		err  bool
+	}{
+		{spec: "", want: nil},
+		{spec: "aes256-ctr,aes128-ctr", want: []string{"aes256-ctr", "aes128-ctr"}},
+		{spec: "+chacha20-poly1305@openssh.com", want: append(defaults[:4:4], "chacha20-poly1305@openssh.com")},
+		{spec: "+aes128-ctr", want: defaults},
+		{spec: "-aes128-ctr", want: []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes256-ctr"}},
+		{spec: "-*-gcm@openssh.com", want: []string{"aes128-ctr", "aes256-ctr"}},
+		{spec: "-aes???-ctr", want: []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com"}},
+		{spec: "-no-such-cipher", want: defaults},
+		{spec: "^aes256-ctr,chacha20-poly1305@openssh.com", want: []string{"aes256-ctr", "chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr"}},
+		// Insecure algorithms have to be asked for by name
+		{spec: "+aes128-cbc,3des-cbc", want: append(defaults[:4:4], "aes128-cbc", "3des-cbc")},
+		{spec: "3des-cbc", want: []string{"3des-cbc"}},
+		{spec: "no-such-cipher", err: true},
+		{spec: "+no-such-cipher", err: true},
+		{spec: "^no-such-cipher", err: true},
+		{spec: "aes*", err: true},
+		{spec: "-*", err: true},
+		// Patterns for removal are plain wildcards, not host patterns
+		{spec: "-aes128-ctr,!aes128-ctr", want: []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes256-ctr"}},
+		{spec: "-AES128-CTR", want: defaults},
+	}
+
+	for _, test := range tests {
+		list, err := algorithmList("cipher", test.spec, defaults, supported)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.spec, list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.want, list)
+		}
+	}
+}
+
+func TestWithoutSecurityKeys(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"", ""},
+		{"ssh-ed25519,sk-ssh-ed25519@openssh.com", "ssh-ed25519"},
+		{"+sk-ecdsa-sha2-nistp256@openssh.com,ssh-ed25519", "+ssh-ed25519"},
+		{"sk-ssh-ed25519@openssh.com", "sk-ssh-ed25519@openssh.com"},
+	}
+
+	for _, test := range tests {
+		if got := withoutSecurityKeys(test.spec); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.spec, test.want, got)
+		}
+	}
+}
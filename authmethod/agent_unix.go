@@ -5,14 +5,43 @@ package authmethod
 import (
 	"net"
 	"os"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-func SSHAgent() ssh.AuthMethod {
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+var (
+	agentMu     sync.Mutex
+	agentSocket string
+	agentClient agent.Agent
+)
+
+// systemAgent returns a client for the agent at SSH_AUTH_SOCK, or nil when
+// there is no agent. The connection is shared by everything that uses the
+// agent.
+func systemAgent() agent.Agent {
+	agentMu.Lock()
+	defer agentMu.Unlock()
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if agentClient == nil || socket != agentSocket {
+		agentClient, agentSocket = nil, socket
+		if sshAgent, err := net.Dial("unix", socket); err == nil {
+			agentClient = agent.NewClient(sshAgent)
+		}
 	}
-	return nil
+	return agentClient
+}
+
+// SSHAgent authenticates with the keys and certificates held by the agent, or
+// the built-in keyring when there is none, pairing its keys with any of
+// certificateFiles issued for them.
+func SSHAgent(certificateFiles ...string) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(SSHAgentSigners(certificateFiles...))
+}
+
+// SSHAgentSigners returns a callback listing the agent's keys.
+func SSHAgentSigners(certificateFiles ...string) func() ([]ssh.Signer, error) {
+	return agentSigners(Agent().Signers, certificateFiles)
 }
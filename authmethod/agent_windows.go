@@ -3,11 +3,25 @@ package authmethod
 import (
 	"github.com/davidmz/go-pageant"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-func SSHAgent() ssh.AuthMethod {
+// systemAgent returns a client for pageant, or nil when it isn't running.
+func systemAgent() agent.Agent {
 	if pageant.Available() {
-		return ssh.PublicKeysCallback(pageant.New().Signers)
+		return pageant.New()
 	}
 	return nil
 }
+
+// SSHAgent authenticates with the keys and certificates held by pageant, or
+// the built-in keyring when it isn't running, pairing its keys with any of
+// certificateFiles issued for them.
+func SSHAgent(certificateFiles ...string) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(SSHAgentSigners(certificateFiles...))
+}
+
+// SSHAgentSigners returns a callback listing pageant's keys.
+func SSHAgentSigners(certificateFiles ...string) func() ([]ssh.Signer, error) {
+	return agentSigners(Agent().Signers, certificateFiles)
+}
@@ -0,0 +1,75 @@
+package authmethod
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LoadCertificates reads OpenSSH user certificates from files, skipping any
+// that don't exist.
+func LoadCertificates(files ...string) []*ssh.Certificate {
+	var certs []*ssh.Certificate
+	for _, file := range files {
+		buffer, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring certificate %s: %v\n", file, err)
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring certificate %s: %v\n", file, err)
+			continue
+		}
+
+		cert, isCert := key.(*ssh.Certificate)
+		if !isCert || cert.CertType != ssh.UserCert {
+			fmt.Fprintf(os.Stderr, "Ignoring certificate %s: not a user certificate\n", file)
+			continue
+		}
+
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// certSigners returns signers with those for certificates first, adding
+// signers for any of certs that belong to the keys of plain signers. Like
+// OpenSSH the plain keys are still offered after the certificates.
+func certSigners(signers []ssh.Signer, certs []*ssh.Certificate) []ssh.Signer {
+	var withCerts, plain []ssh.Signer
+	for _, signer := range signers {
+		if _, isCert := signer.PublicKey().(*ssh.Certificate); isCert {
+			withCerts = append(withCerts, signer)
+			continue
+		}
+
+		for _, cert := range certs {
+			if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+				continue
+			}
+			if certSigner, err := ssh.NewCertSigner(cert, signer); err == nil {
+				withCerts = append(withCerts, certSigner)
+			}
+		}
+		plain = append(plain, signer)
+	}
+	return append(withCerts, plain...)
+}
+
+// agentSigners lists the keys from an agent with their certificates first.
+func agentSigners(signers func() ([]ssh.Signer, error), certificateFiles []string) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		keys, err := signers()
+		if err != nil {
+			return nil, err
+		}
+		return certSigners(keys, LoadCertificates(certificateFiles...)), nil
+	}
+}
@@ -0,0 +1,167 @@
+package authmethod_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/freman/sshcode/authmethod"
+	"golang.org/x/crypto/ssh"
+)
+
+func newKey(t *testing.T) (ed25519.PrivateKey, ssh.PublicKey) {
+	t.Helper()
+
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, sshPublic
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	key, _ := newKey(t)
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeCertificate signs key with ca and writes the certificate to file.
+func writeCertificate(t *testing.T, file string, ca ssh.Signer, key ssh.PublicKey) {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "freman",
+		ValidPrincipals: []string{"freman"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(file, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func privateKey(t *testing.T, dir string) (string, ssh.PublicKey) {
+	t.Helper()
+
+	buffer, err := ioutil.ReadFile(filepath.Join("testdata", "testnopass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "id_test")
+	if err := ioutil.WriteFile(file, buffer, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, signer.PublicKey()
+}
+
+// certOnlyServer only accepts certificates signed by ca.
+func certOnlyServer(ca ssh.PublicKey) *ssh.ServerConfig {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.Marshal())
+		},
+		UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("only certificates are accepted")
+		},
+	}
+	return &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+}
+
+func TestPrivateKeyFileCertificate(t *testing.T) {
+	t.Parallel()
+
+	ca := newSigner(t)
+	dir := t.TempDir()
+	file, key := privateKey(t, dir)
+	writeCertificate(t, file+"-cert.pub", ca, key)
+
+	method, err := authmethod.PrivateKeyFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authenticate(t, certOnlyServer(ca.PublicKey()), method); err != nil {
+		t.Fatalf("expected to authenticate with the certificate, got %v", err)
+	}
+}
+
+func TestPrivateKeyFileCertificateFile(t *testing.T) {
+	t.Parallel()
+
+	ca := newSigner(t)
+	dir := t.TempDir()
+	file, key := privateKey(t, dir)
+
+	// A certificate for another key is ignored
+	other := filepath.Join(dir, "other-cert.pub")
+	writeCertificate(t, other, ca, newSigner(t).PublicKey())
+
+	certFile := filepath.Join(dir, "signed.pub")
+	writeCertificate(t, certFile, ca, key)
+
+	method, err := authmethod.PrivateKeyFile(file, nil, other, filepath.Join(dir, "missing-cert.pub"), certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authenticate(t, certOnlyServer(ca.PublicKey()), method); err != nil {
+		t.Fatalf("expected to authenticate with the certificate, got %v", err)
+	}
+}
+
+func TestPrivateKeyFileWithoutCertificate(t *testing.T) {
+	t.Parallel()
+
+	ca := newSigner(t)
+	dir := t.TempDir()
+	file, _ := privateKey(t, dir)
+
+	other := filepath.Join(dir, "other-cert.pub")
+	writeCertificate(t, other, ca, newSigner(t).PublicKey())
+
+	method, err := authmethod.PrivateKeyFile(file, nil, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authenticate(t, certOnlyServer(ca.PublicKey()), method); err == nil {
+		t.Fatal("expected authentication without a matching certificate to fail")
+	}
+}
+
+func TestLoadCertificates(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "id-cert.pub")
+	writeCertificate(t, certFile, newSigner(t), newSigner(t).PublicKey())
+
+	certs := authmethod.LoadCertificates(
+		certFile,
+		filepath.Join(dir, "missing-cert.pub"),
+		filepath.Join("testdata", "testnopass.pub"),
+	)
+	if len(certs) != 1 || certs[0].KeyId != "freman" {
+		t.Errorf("expected only the certificate to load, got %v", certs)
+	}
+}
@@ -0,0 +1,99 @@
+package authmethod
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// NumberOfPasswordPrompts is how many times a password or passphrase is asked
+// for before giving up, as in OpenSSH.
+var NumberOfPasswordPrompts = 3
+
+// DisableInteractive skips password and keyboard-interactive authentication
+// without asking anything. It may be set until authentication starts, as when
+// the host key turns out to have changed.
+var DisableInteractive bool
+
+// ErrInteractiveDisabled is returned by Password and KeyboardInteractive when
+// DisableInteractive is set.
+var ErrInteractiveDisabled = errors.New("password and keyboard-interactive authentication are disabled")
+
+// Password asks for the password of user on host when the server offers
+// password authentication.
+func Password(user, host string, prompt func(msg string) []byte) ssh.AuthMethod {
+	return ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+		if DisableInteractive {
+			return "", ErrInteractiveDisabled
+		}
+		return string(prompt(user + "@" + host + "'s password: ")), nil
+	}), NumberOfPasswordPrompts)
+}
+
+// KeyboardInteractive answers the server's challenges, which may hold any
+// number of questions such as a password followed by a one time code. Answers
+// to questions that may be shown go to echo, the rest to prompt. When echo is
+// nil everything is asked through prompt.
+func KeyboardInteractive(prompt, echo func(msg string) []byte) ssh.AuthMethod {
+	if echo == nil {
+		echo = prompt
+	}
+
+	return ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			return nil, nil
+		}
+		if DisableInteractive {
+			return nil, ErrInteractiveDisabled
+		}
+
+		if name != "" {
+			fmt.Println(name)
+		}
+		if instruction != "" {
+			fmt.Println(instruction)
+		}
+
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			if echos[i] {
+				answers[i] = string(echo(question))
+			} else {
+				answers[i] = string(prompt(question))
+			}
+		}
+		return answers, nil
+	}), NumberOfPasswordPrompts)
+}
+
+// stdin is shared by every prompt, so input buffered while reading one answer
+// isn't lost to the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// PromptLine reads a visible answer from the terminal.
+func PromptLine(msg string) []byte {
+	fmt.Print(msg)
+	line, err := stdin.ReadBytes('\n')
+	if err != nil {
+		fmt.Println()
+	}
+	return bytes.TrimSpace(line)
+}
+
+// PromptConfirm asks a yes/no question on the terminal until it gets an
+// answer.
+func PromptConfirm(msg string) bool {
+	for {
+		switch string(bytes.ToLower(PromptLine(msg))) {
+		case "yes":
+			return true
+		case "no", "":
+			return false
+		}
+		msg = "Please type 'yes' or 'no': "
+	}
+}
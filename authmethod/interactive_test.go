@@ -0,0 +1,208 @@
+package authmethod_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/freman/sshcode/authmethod"
+	"golang.org/x/crypto/ssh"
+)
+
+// authenticate runs a handshake between config and a client using method,
+// reporting whether the client got in.
+func authenticate(t *testing.T, config *ssh.ServerConfig, method ssh.AuthMethod) error {
+	t.Helper()
+
+	config.AddHostKey(newSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		if conn, chans, reqs, err := ssh.NewServerConn(serverConn, config); err == nil {
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+			conn.Wait()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "freman",
+		Auth:            []ssh.AuthMethod{method},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+	}
+	return err
+}
+
+func answers(list ...string) (func(msg string) []byte, *[]string) {
+	var asked []string
+	return func(msg string) []byte {
+		asked = append(asked, msg)
+		if len(list) == 0 {
+			return nil
+		}
+		answer := list[0]
+		list = list[1:]
+		return []byte(answer)
+	}, &asked
+}
+
+func TestPassword(t *testing.T) {
+	t.Parallel()
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "freman" && string(password) == "password" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+
+	prompt, asked := answers("secret", "password")
+	if err := authenticate(t, config, authmethod.Password("freman", "example.com", prompt)); err != nil {
+		t.Fatalf("expected to authenticate, got %v", err)
+	}
+
+	if len(*asked) != 2 {
+		t.Fatalf("expected 2 prompts, got %q", *asked)
+	}
+	if (*asked)[0] != "freman@example.com's password: " {
+		t.Errorf("unexpected prompt %q", (*asked)[0])
+	}
+}
+
+func TestPasswordGivesUp(t *testing.T) {
+	t.Parallel()
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("wrong password")
+		},
+	}
+
+	prompt, asked := answers("one", "two", "three", "four")
+	if err := authenticate(t, config, authmethod.Password("freman", "example.com", prompt)); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+
+	if len(*asked) != 3 {
+		t.Errorf("expected 3 prompts, got %d", len(*asked))
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	t.Parallel()
+
+	config := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: ", "Username for OTP: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if answers[0] != "password" || answers[1] != "freman" {
+				return nil, errors.New("wrong password")
+			}
+
+			// Duo style second factor as its own round
+			answers, err = challenge("Duo two-factor login", "", []string{"Passcode or option (1-2): "}, []bool{true})
+			if err != nil {
+				return nil, err
+			}
+			if answers[0] != "123456" {
+				return nil, errors.New("wrong passcode")
+			}
+
+			// Some servers finish with an empty challenge
+			if _, err := challenge("", "", nil, nil); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		},
+	}
+
+	prompt, hidden := answers("password")
+	echo, shown := answers("freman", "123456")
+	if err := authenticate(t, config, authmethod.KeyboardInteractive(prompt, echo)); err != nil {
+		t.Fatalf("expected to authenticate, got %v", err)
+	}
+
+	if len(*hidden) != 1 || (*hidden)[0] != "Password: " {
+		t.Errorf("unexpected hidden prompts %q", *hidden)
+	}
+	if len(*shown) != 2 || (*shown)[1] != "Passcode or option (1-2): " {
+		t.Errorf("unexpected echoed prompts %q", *shown)
+	}
+}
+
+func TestKeyboardInteractiveRetry(t *testing.T) {
+	t.Parallel()
+
+	config := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Verification code: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if answers[0] != "424242" {
+				return nil, errors.New("wrong code")
+			}
+			return nil, nil
+		},
+	}
+
+	prompt, asked := answers("111111", "424242")
+	if err := authenticate(t, config, authmethod.KeyboardInteractive(prompt, nil)); err != nil {
+		t.Fatalf("expected to authenticate, got %v", err)
+	}
+
+	if len(*asked) != 2 {
+		t.Errorf("expected 2 prompts, got %d", len(*asked))
+	}
+}
+
+func TestInteractiveDisabled(t *testing.T) {
+	// Not parallel, as DisableInteractive is shared
+	authmethod.DisableInteractive = true
+	defer func() { authmethod.DisableInteractive = false }()
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			_, err := challenge("", "", []string{"Password: "}, []bool{false})
+			return nil, err
+		},
+	}
+
+	prompt, asked := answers("password", "password")
+	for _, method := range []ssh.AuthMethod{
+		authmethod.Password("freman", "example.com", prompt),
+		authmethod.KeyboardInteractive(prompt, nil),
+	} {
+		if err := authenticate(t, config, method); err == nil {
+			t.Error("expected authentication to be skipped")
+		}
+	}
+
+	if len(*asked) != 0 {
+		t.Errorf("expected no prompts, got %q", *asked)
+	}
+}
@@ -0,0 +1,255 @@
+package authmethod
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// UseSystemAgent can be turned off to keep keys away from SSH_AUTH_SOCK or
+// pageant, leaving Agent to the built-in keyring.
+var UseSystemAgent = true
+
+// BuiltinAgent holds keys when there's no system agent to hold them, as on
+// Windows without pageant.
+var BuiltinAgent = NewKeyring(PromptConfirm)
+
+// AddKeys describes how keys decrypted from identity files are added to the
+// agent, as with OpenSSH's AddKeysToAgent.
+type AddKeys struct {
+	// Lifetime, if not zero, is how long the agent keeps the key.
+	Lifetime time.Duration
+	// Confirm asks before each use of the key.
+	Confirm bool
+	// Ask asks before adding the key at all.
+	Ask bool
+}
+
+// AddKeysToAgent adds keys to Agent once they are read from identity files,
+// nil leaves them out.
+var AddKeysToAgent *AddKeys
+
+// Agent returns the system agent, falling back to BuiltinAgent when there is
+// none or UseSystemAgent is off.
+func Agent() agent.Agent {
+	if sshAgent := SystemAgent(); sshAgent != nil {
+		return sshAgent
+	}
+	return BuiltinAgent
+}
+
+// SystemAgent returns the system agent, or nil when there is none or
+// UseSystemAgent is off.
+func SystemAgent() agent.Agent {
+	if !UseSystemAgent {
+		return nil
+	}
+	return systemAgent()
+}
+
+// addToAgent hands a key read from file to Agent according to
+// AddKeysToAgent.
+func addToAgent(file string, key interface{}) {
+	add := AddKeysToAgent
+	if add == nil {
+		return
+	}
+
+	if add.Ask && !PromptConfirm("Add key "+file+" to the agent? (yes/no) ") {
+		return
+	}
+
+	err := Agent().Add(agent.AddedKey{
+		PrivateKey:       key,
+		Comment:          file,
+		LifetimeSecs:     uint32(add.Lifetime / time.Second),
+		ConfirmBeforeUse: add.Confirm,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add %s to the agent: %v\n", file, err)
+	}
+}
+
+// ErrRefused is returned when signing with a key is turned down at the
+// confirmation prompt.
+var ErrRefused = errors.New("agent: use of key refused")
+
+// Keyring is an in-memory agent. It keeps keys for their lifetime like
+// agent.NewKeyring, and asks through confirm before signing with keys added
+// with ConfirmBeforeUse.
+type Keyring struct {
+	keys    agent.ExtendedAgent
+	confirm func(msg string) bool
+
+	mu          sync.Mutex
+	confirmKeys map[string]string
+
+	// Only one question is asked at a time
+	prompt sync.Mutex
+}
+
+// NewKeyring returns an empty keyring asking through confirm, which may be
+// nil to refuse keys that need confirming.
+func NewKeyring(confirm func(msg string) bool) *Keyring {
+	return &Keyring{
+		keys:        agent.NewKeyring().(agent.ExtendedAgent),
+		confirm:     confirm,
+		confirmKeys: map[string]string{},
+	}
+}
+
+func (k *Keyring) List() ([]*agent.Key, error) {
+	return k.keys.List()
+}
+
+func (k *Keyring) Add(key agent.AddedKey) error {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	if err := k.keys.Add(key); err != nil {
+		return err
+	}
+
+	blobs := []string{string(signer.PublicKey().Marshal())}
+	if key.Certificate != nil {
+		blobs = append(blobs, string(key.Certificate.Marshal()))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, blob := range blobs {
+		if key.ConfirmBeforeUse {
+			k.confirmKeys[blob] = key.Comment
+		} else {
+			delete(k.confirmKeys, blob)
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) Remove(key ssh.PublicKey) error {
+	k.mu.Lock()
+	delete(k.confirmKeys, string(key.Marshal()))
+	k.mu.Unlock()
+
+	return k.keys.Remove(key)
+}
+
+func (k *Keyring) RemoveAll() error {
+	k.mu.Lock()
+	k.confirmKeys = map[string]string{}
+	k.mu.Unlock()
+
+	return k.keys.RemoveAll()
+}
+
+func (k *Keyring) Lock(passphrase []byte) error {
+	return k.keys.Lock(passphrase)
+}
+
+func (k *Keyring) Unlock(passphrase []byte) error {
+	return k.keys.Unlock(passphrase)
+}
+
+func (k *Keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return k.SignWithFlags(key, data, 0)
+}
+
+func (k *Keyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := k.confirmUse(key); err != nil {
+		return nil, err
+	}
+	return k.keys.SignWithFlags(key, data, flags)
+}
+
+func (k *Keyring) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return k.keys.Extension(extensionType, contents)
+}
+
+// Signers returns signers that go through the keyring, so keys still need
+// confirming and stop working once they expire.
+func (k *Keyring) Signers() ([]ssh.Signer, error) {
+	keys, err := k.keys.List()
+	if err != nil {
+		return nil, err
+	}
+
+	signers := make([]ssh.Signer, len(keys))
+	for i, key := range keys {
+		signers[i] = &keyringSigner{keyring: k, public: key}
+	}
+	return signers, nil
+}
+
+// confirmUse asks before key is used if it was added with ConfirmBeforeUse.
+func (k *Keyring) confirmUse(key ssh.PublicKey) error {
+	k.mu.Lock()
+	comment, ask := k.confirmKeys[string(key.Marshal())]
+	k.mu.Unlock()
+	if !ask {
+		return nil
+	}
+
+	// Don't ask about keys that have expired
+	if !k.holds(key) {
+		return errors.New("agent: key not found")
+	}
+
+	if k.confirm == nil {
+		return ErrRefused
+	}
+
+	k.prompt.Lock()
+	defer k.prompt.Unlock()
+	if !k.confirm(fmt.Sprintf("Allow use of key %s?\nKey fingerprint %s. (yes/no) ", comment, ssh.FingerprintSHA256(key))) {
+		return ErrRefused
+	}
+	return nil
+}
+
+func (k *Keyring) holds(key ssh.PublicKey) bool {
+	keys, err := k.keys.List()
+	if err != nil {
+		return false
+	}
+	for _, held := range keys {
+		if string(held.Marshal()) == string(key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyringSigner signs with a key held by a Keyring.
+type keyringSigner struct {
+	keyring *Keyring
+	public  ssh.PublicKey
+}
+
+func (s *keyringSigner) PublicKey() ssh.PublicKey {
+	return s.public
+}
+
+func (s *keyringSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.keyring.Sign(s.public, data)
+}
+
+// SignWithAlgorithm lets RSA keys sign with SHA-2 as servers expect.
+func (s *keyringSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256, ssh.CertAlgoRSASHA256v01:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512, ssh.CertAlgoRSASHA512v01:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	return s.keyring.SignWithFlags(s.public, data, flags)
+}
@@ -0,0 +1,160 @@
+package authmethod_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/authmethod"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestKeyringConfirm(t *testing.T) {
+	t.Parallel()
+
+	var asked []string
+	allow := false
+	keyring := authmethod.NewKeyring(func(msg string) bool {
+		asked = append(asked, msg)
+		return allow
+	})
+
+	key, public := newKey(t)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "id_test", ConfirmBeforeUse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	signers, err := keyring.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offered []string
+	if err := authenticate(t, publicKeyServer(public, &offered), ssh.PublicKeys(signers...)); err == nil {
+		t.Fatal("expected authentication to fail when use of the key is refused")
+	}
+	if len(asked) != 1 || !strings.Contains(asked[0], "id_test") || !strings.Contains(asked[0], ssh.FingerprintSHA256(public)) {
+		t.Errorf("expected to be asked about id_test once, got %q", asked)
+	}
+
+	allow = true
+	if err := authenticate(t, publicKeyServer(public, &offered), ssh.PublicKeys(signers...)); err != nil {
+		t.Fatalf("expected to authenticate once use of the key is allowed, got %v", err)
+	}
+	if len(asked) != 2 {
+		t.Errorf("expected to be asked again, got %d questions", len(asked))
+	}
+
+	// Adding the key again without the constraint stops the questions
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Sign(public, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 2 {
+		t.Errorf("expected no more questions, got %d", len(asked))
+	}
+}
+
+func TestKeyringConfirmWithoutPrompt(t *testing.T) {
+	t.Parallel()
+
+	keyring := authmethod.NewKeyring(nil)
+	key, public := newKey(t)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, ConfirmBeforeUse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keyring.Sign(public, []byte("data")); !errors.Is(err, authmethod.ErrRefused) {
+		t.Errorf("expected %v, got %v", authmethod.ErrRefused, err)
+	}
+}
+
+func TestKeyringLifetime(t *testing.T) {
+	t.Parallel()
+
+	var asked int
+	keyring := authmethod.NewKeyring(func(string) bool {
+		asked++
+		return true
+	})
+
+	key, public := newKey(t)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, LifetimeSecs: 1, ConfirmBeforeUse: true}); err != nil {
+		t.Fatal(err)
+	}
+	signers, err := keyring.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("expected a key, got %d", len(signers))
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if keys, err := keyring.List(); err != nil || len(keys) != 0 {
+		t.Errorf("expected the key to have expired, got %d keys (%v)", len(keys), err)
+	}
+	if _, err := signers[0].Sign(rand.Reader, []byte("data")); err == nil {
+		t.Error("expected signing with an expired key to fail")
+	}
+	if _, err := keyring.Sign(public, []byte("data")); err == nil {
+		t.Error("expected signing with an expired key to fail")
+	}
+	if asked != 0 {
+		t.Errorf("expected no questions about an expired key, got %d", asked)
+	}
+}
+
+func TestAddKeysToAgent(t *testing.T) {
+	defer func(use bool, builtin *authmethod.Keyring, add *authmethod.AddKeys) {
+		authmethod.UseSystemAgent, authmethod.BuiltinAgent, authmethod.AddKeysToAgent = use, builtin, add
+	}(authmethod.UseSystemAgent, authmethod.BuiltinAgent, authmethod.AddKeysToAgent)
+
+	authmethod.UseSystemAgent = false
+	authmethod.BuiltinAgent = authmethod.NewKeyring(nil)
+	authmethod.AddKeysToAgent = &authmethod.AddKeys{Lifetime: time.Hour}
+
+	file := filepath.Join("testdata", "testpass")
+	public := publicKey(t, file+".pub")
+
+	var prompts int
+	signers, err := authmethod.PrivateKeySigners(file, func(string) []byte {
+		prompts++
+		return []byte("password")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, _ := authmethod.Agent().List(); len(keys) != 0 {
+		t.Fatalf("expected the key to wait until it is decrypted, got %d keys", len(keys))
+	}
+
+	var offered []string
+	if err := authenticate(t, publicKeyServer(public, &offered), ssh.PublicKeys(signers...)); err != nil {
+		t.Fatalf("expected to authenticate, got %v", err)
+	}
+
+	keys, err := authmethod.Agent().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0].Marshal()) != string(public.Marshal()) || keys[0].Comment != file {
+		t.Fatalf("expected the decrypted key in the built-in agent, got %v", keys)
+	}
+
+	// Later connections use the agent without asking again
+	if err := authenticate(t, publicKeyServer(public, &offered), authmethod.SSHAgent()); err != nil {
+		t.Fatalf("expected to authenticate through the agent, got %v", err)
+	}
+	if prompts != 1 {
+		t.Errorf("expected a single passphrase prompt, got %d", prompts)
+	}
+}
@@ -0,0 +1,83 @@
+package authmethod
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// lazySigner stands in for a private key using only its public half, loading
+// the private key the first time something needs signing.
+type lazySigner struct {
+	public ssh.PublicKey
+	load   func() (ssh.Signer, error)
+
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+func (s *lazySigner) PublicKey() ssh.PublicKey {
+	return s.public
+}
+
+func (s *lazySigner) loaded() (ssh.Signer, error) {
+	s.once.Do(func() {
+		s.signer, s.err = s.load()
+		if s.err == nil && !bytes.Equal(s.signer.PublicKey().Marshal(), s.public.Marshal()) {
+			s.signer, s.err = nil, fmt.Errorf("private key doesn't match its %s public key", ssh.FingerprintSHA256(s.public))
+		}
+	})
+	return s.signer, s.err
+}
+
+func (s *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.loaded()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+// SignWithAlgorithm lets RSA keys sign with SHA-2 as servers expect.
+func (s *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.loaded()
+	if err != nil {
+		return nil, err
+	}
+	algorithmSigner, isa := signer.(ssh.AlgorithmSigner)
+	if !isa {
+		return nil, fmt.Errorf("%s keys can't sign with %s", s.public.Type(), algorithm)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// PublicKeys offers the keys from agent, which may be nil, followed by
+// signers in a single public key method. The ssh client only tries the first
+// method of each kind, so keys from every source need to be offered together.
+// Keys are offered once, the first time they are found.
+func PublicKeys(agent func() ([]ssh.Signer, error), signers ...ssh.Signer) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var all []ssh.Signer
+		if agent != nil {
+			// Carry on with the other keys if the agent has gone away
+			if keys, err := agent(); err == nil {
+				all = append(all, keys...)
+			}
+		}
+
+		var offered []ssh.Signer
+		seen := map[string]bool{}
+		for _, signer := range append(all, signers...) {
+			key := string(signer.PublicKey().Marshal())
+			if !seen[key] {
+				seen[key] = true
+				offered = append(offered, signer)
+			}
+		}
+		return offered, nil
+	})
+}
@@ -0,0 +1,106 @@
+package authmethod_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/freman/sshcode/authmethod"
+	"golang.org/x/crypto/ssh"
+)
+
+// publicKeyServer accepts only key, recording the keys offered and the ones
+// it was asked to verify signatures from.
+func publicKeyServer(key ssh.PublicKey, offered *[]string) *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			*offered = append(*offered, ssh.FingerprintSHA256(k))
+			if string(k.Marshal()) == string(key.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+}
+
+func publicKey(t *testing.T, file string) ssh.PublicKey {
+	t.Helper()
+
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestPrivateKeySignersLazy(t *testing.T) {
+	t.Parallel()
+
+	var prompts int
+	prompt := func(string) []byte {
+		prompts++
+		return []byte("password")
+	}
+
+	signers, err := authmethod.PrivateKeySigners(filepath.Join("testdata", "testpass"), prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("expected a signer, got %d", len(signers))
+	}
+	if prompts != 0 {
+		t.Fatal("expected no passphrase prompt before the key is used")
+	}
+
+	// Rejected keys are never decrypted
+	var offered []string
+	if err := authenticate(t, publicKeyServer(newSigner(t).PublicKey(), &offered), ssh.PublicKeys(signers...)); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	if prompts != 0 {
+		t.Errorf("expected no passphrase prompt for a rejected key, got %d", prompts)
+	}
+
+	offered = nil
+	if err := authenticate(t, publicKeyServer(publicKey(t, filepath.Join("testdata", "testpass.pub")), &offered), ssh.PublicKeys(signers...)); err != nil {
+		t.Fatalf("expected to authenticate, got %v", err)
+	}
+	if prompts != 1 {
+		t.Errorf("expected a single passphrase prompt, got %d", prompts)
+	}
+}
+
+func TestPublicKeys(t *testing.T) {
+	t.Parallel()
+
+	agentKey, fileKey := newSigner(t), newSigner(t)
+	agent := func() ([]ssh.Signer, error) {
+		return []ssh.Signer{agentKey}, nil
+	}
+
+	var offered []string
+	method := authmethod.PublicKeys(agent, agentKey, fileKey)
+	if err := authenticate(t, publicKeyServer(fileKey.PublicKey(), &offered), method); err != nil {
+		t.Fatalf("expected to authenticate with the second key, got %v", err)
+	}
+
+	want := []string{ssh.FingerprintSHA256(agentKey.PublicKey()), ssh.FingerprintSHA256(fileKey.PublicKey())}
+	if len(offered) < 2 || offered[0] != want[0] || offered[len(offered)-1] != want[1] {
+		t.Errorf("expected keys offered in order %q, got %q", want, offered)
+	}
+
+	// An agent that has gone away doesn't stop the other keys being offered
+	broken := func() ([]ssh.Signer, error) {
+		return nil, errors.New("agent gone")
+	}
+	offered = nil
+	if err := authenticate(t, publicKeyServer(fileKey.PublicKey(), &offered), authmethod.PublicKeys(broken, fileKey)); err != nil {
+		t.Fatalf("expected to authenticate without the agent, got %v", err)
+	}
+}
@@ -2,66 +2,202 @@ package authmethod
 
 import (
 	"bytes"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 
 	"github.com/ScaleFT/sshkeys"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/howeyc/gopass"
 	"golang.org/x/crypto/ssh"
 )
 
-func PrivateKeyFile(file string, prompt func(msg string) []byte) ssh.AuthMethod {
-	buffer, err := ioutil.ReadFile(file)
+// Reasons a private key can't be used, wrapped in a KeyError.
+var (
+	ErrKeyNotFound        = errors.New("no such private key")
+	ErrUnsupportedKey     = errors.New("unsupported private key format")
+	ErrWrongPassphrase    = errors.New("incorrect passphrase")
+	ErrNoPassphrase       = errors.New("no passphrase given")
+	ErrTooManyPassphrases = errors.New("too many incorrect passphrases")
+	ErrSecurityKey        = errors.New("security keys can only be used through an agent")
+)
+
+// KeyError describes why the private key in File couldn't be used.
+type KeyError struct {
+	File string
+	Err  error
+}
+
+func (e *KeyError) Error() string {
+	return e.File + ": " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// PrivateKeyFile authenticates with the key in file along with the
+// certificate in file-cert.pub and any of certificateFiles issued for it.
+func PrivateKeyFile(file string, prompt func(msg string) []byte, certificateFiles ...string) (ssh.AuthMethod, error) {
+	signers, err := PrivateKeySigners(file, prompt, certificateFiles...)
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	return ssh.PublicKeys(signers...), nil
+}
+
+// PrivateKeySigners returns a signer for the key in file preceded by those for
+// its certificates. When the public key is found in file.pub or
+// file-cert.pub, reading the private key and asking for its passphrase is put
+// off until the server accepts the key, so errors from that show up when
+// signing.
+func PrivateKeySigners(file string, prompt func(msg string) []byte, certificateFiles ...string) ([]ssh.Signer, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, &KeyError{File: file, Err: ErrKeyNotFound}
+	} else if err != nil {
+		return nil, &KeyError{File: file, Err: err}
+	}
+
+	certs := LoadCertificates(append([]string{file + "-cert.pub"}, certificateFiles...)...)
 
-	var msg = "Enter passphrase for " + file
-	var passPhrase []byte
-	passPhrasePrompt := func() []byte {
-		if len(passPhrase) > 0 {
-			return passPhrase
+	var key ssh.Signer
+	if public := PublicKeyFile(file); public != nil {
+		// The private half of a security key is only a handle for the
+		// hardware, which needs an agent to talk to
+		if IsSecurityKey(public) {
+			return nil, &KeyError{File: file, Err: ErrSecurityKey}
 		}
-		for len(passPhrase) == 0 {
-			passPhrase = prompt(msg)
+
+		key = &lazySigner{public: public, load: func() (ssh.Signer, error) {
+			return parsePrivateKeyFile(file, prompt)
+		}}
+	} else {
+		var err error
+		if key, err = parsePrivateKeyFile(file, prompt); err != nil {
+			return nil, err
 		}
-		return passPhrase
 	}
 
-	methods := []func() (ssh.Signer, error){
-		func() (ssh.Signer, error) { return ssh.ParsePrivateKey(buffer) },
-		func() (ssh.Signer, error) { return ssh.ParsePrivateKeyWithPassphrase(buffer, passPhrasePrompt()) },
-		func() (ssh.Signer, error) { return sshkeys.ParseEncryptedPrivateKey(buffer, passPhrasePrompt()) },
+	return certSigners([]ssh.Signer{key}, certs), nil
+}
+
+// IsSecurityKey reports whether key, or the key a certificate is for, is held
+// by a FIDO/U2F security key.
+func IsSecurityKey(key ssh.PublicKey) bool {
+	if cert, isCert := key.(*ssh.Certificate); isCert {
+		key = cert.Key
 	}
 
-retryLoop:
-	for {
-		for _, method := range methods {
-			key, err := method()
-			if err != nil {
-				if err.Error() == "ssh: cannot decode encrypted private keys" {
-					continue
-				}
-				if err == sshkeys.ErrIncorrectPassword {
-					fmt.Fprintln(os.Stderr, "Invalid passphrase")
-					passPhrase = []byte{}
-					msg = "Bad passphrase, try again for " + file
-					continue retryLoop
-				}
-			}
-			return ssh.PublicKeys(key)
+	switch key.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	}
+	return false
+}
+
+// PublicKeyFile returns the public key kept alongside the private key in
+// file, if any.
+func PublicKeyFile(file string) ssh.PublicKey {
+	for _, name := range []string{file + ".pub", file + "-cert.pub"} {
+		buffer, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
 		}
-		return nil
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+		if err != nil {
+			continue
+		}
+
+		if cert, isCert := key.(*ssh.Certificate); isCert {
+			key = cert.Key
+		}
+		return key
+	}
+	return nil
+}
+
+// parsePrivateKeyFile reads the key in file, asking for its passphrase if
+// needed, and adds it to the agent when AddKeysToAgent is set.
+func parsePrivateKeyFile(file string, prompt func(msg string) []byte) (ssh.Signer, error) {
+	key, err := readPrivateKeyFile(file, prompt)
+	if err != nil {
+		return nil, err
 	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, &KeyError{File: file, Err: fmt.Errorf("%w: %v", ErrUnsupportedKey, err)}
+	}
+
+	addToAgent(file, key)
+	return signer, nil
+}
+
+func readPrivateKeyFile(file string, prompt func(msg string) []byte) (interface{}, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, &KeyError{File: file, Err: ErrKeyNotFound}
+	} else if err != nil {
+		return nil, &KeyError{File: file, Err: err}
+	}
+
+	key, err := ssh.ParseRawPrivateKey(buffer)
+	if err == nil {
+		return key, nil
+	}
+	if _, isa := err.(*ssh.PassphraseMissingError); !isa && err.Error() != "ssh: cannot decode encrypted private keys" {
+		return nil, &KeyError{File: file, Err: fmt.Errorf("%w: %v", ErrUnsupportedKey, err)}
+	}
+
+	msg := "Enter passphrase for " + file + ": "
+	for attempt := 0; attempt < NumberOfPasswordPrompts; attempt++ {
+		passPhrase := prompt(msg)
+		if len(passPhrase) == 0 {
+			return nil, &KeyError{File: file, Err: ErrNoPassphrase}
+		}
+
+		key, err := parseEncryptedPrivateKey(buffer, passPhrase)
+		if err == nil {
+			return key, nil
+		}
+		if err != ErrWrongPassphrase {
+			return nil, &KeyError{File: file, Err: err}
+		}
+
+		fmt.Fprintln(os.Stderr, "Invalid passphrase")
+		msg = "Bad passphrase, try again for " + file + ": "
+	}
+
+	return nil, &KeyError{File: file, Err: ErrTooManyPassphrases}
+}
+
+// parseEncryptedPrivateKey decrypts keys in the formats x/crypto/ssh handles,
+// falling back to sshkeys for the rest.
+func parseEncryptedPrivateKey(buffer, passPhrase []byte) (interface{}, error) {
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(buffer, passPhrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, ErrWrongPassphrase
+	} else if err == nil {
+		return key, nil
+	}
+
+	key, err = sshkeys.ParseEncryptedRawPrivateKey(buffer, passPhrase)
+	if err == sshkeys.ErrIncorrectPassword {
+		return nil, ErrWrongPassphrase
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+	}
+	return key, nil
 }
 
 func PromptPassword(msg string) []byte {
 	fmt.Print(msg)
 	pass, err := gopass.GetPasswd()
 	if err != nil {
-		spew.Dump(err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil
 	}
 	return bytes.TrimSpace(pass)
 }
@@ -1,10 +1,13 @@
 package authmethod_test
 
 import (
+	"errors"
+	"io/ioutil"
 	"path/filepath"
 	"testing"
 
 	"github.com/freman/sshcode/authmethod"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestPrivateKeyFile(t *testing.T) {
@@ -14,7 +17,10 @@ func TestPrivateKeyFile(t *testing.T) {
 		file := file // capture range variable
 		t.Run(file, func(t *testing.T) {
 			t.Parallel()
-			method := authmethod.PrivateKeyFile(filepath.Join("testdata", file), func(string) []byte { return []byte("password") })
+			method, err := authmethod.PrivateKeyFile(filepath.Join("testdata", file), func(string) []byte { return []byte("password") })
+			if err != nil {
+				t.Fatal(err)
+			}
 			if method == nil {
 				t.Error("expected an auth method")
 			}
@@ -31,17 +37,188 @@ func TestPrivateKeyFileBadPassword(t *testing.T) {
 	}
 
 	var attempts = 0
-	method := authmethod.PrivateKeyFile(filepath.Join("testdata", "testpass"), func(string) []byte {
+	method, err := authmethod.PrivateKeyFile(filepath.Join("testdata", "testpass"), func(string) []byte {
 		password := passwords[attempts]
 		attempts++
 		return password
 	})
 
-	if method == nil {
-		t.Error("expected an auth method")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 0 {
+		t.Errorf("expected no prompts before the key is used, not %d", attempts)
+	}
+
+	var offered []string
+	if err = authenticate(t, publicKeyServer(publicKey(t, filepath.Join("testdata", "testpass.pub")), &offered), method); err != nil {
+		t.Fatalf("expected to authenticate, got %v", err)
 	}
 
 	if attempts != 3 {
 		t.Errorf("expected it to succeed on attempt 3, not %d", attempts)
 	}
 }
+
+func TestPrivateKeySignersOrder(t *testing.T) {
+	t.Parallel()
+
+	var prompts int
+	prompt := func(string) []byte {
+		prompts++
+		return []byte("password")
+	}
+
+	pass := publicKey(t, filepath.Join("testdata", "testpass.pub"))
+	nopass := publicKey(t, filepath.Join("testdata", "testnopass.pub"))
+
+	tests := []struct {
+		name    string
+		files   []string
+		accept  ssh.PublicKey
+		offered []ssh.PublicKey
+		prompts int
+	}{
+		{
+			name:    "encrypted key rejected",
+			files:   []string{"testpass", "testnopass"},
+			accept:  nopass,
+			offered: []ssh.PublicKey{pass, nopass},
+		},
+		{
+			name:    "encrypted key accepted",
+			files:   []string{"testnopass", "testpass"},
+			accept:  pass,
+			offered: []ssh.PublicKey{nopass, pass},
+			prompts: 1,
+		},
+		{
+			name:    "duplicates offered once",
+			files:   []string{"testnopass", "testpass", "testnopass"},
+			accept:  pass,
+			offered: []ssh.PublicKey{nopass, pass},
+			prompts: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prompts = 0
+
+			var signers []ssh.Signer
+			for _, file := range test.files {
+				keys, err := authmethod.PrivateKeySigners(filepath.Join("testdata", file), prompt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				signers = append(signers, keys...)
+			}
+
+			var offered []string
+			if err := authenticate(t, publicKeyServer(test.accept, &offered), authmethod.PublicKeys(nil, signers...)); err != nil {
+				t.Fatalf("expected to authenticate, got %v", err)
+			}
+
+			// The client queries each key before signing with the accepted one
+			var want []string
+			for _, key := range test.offered {
+				want = append(want, ssh.FingerprintSHA256(key))
+			}
+			if len(offered) < len(want) {
+				t.Fatalf("expected keys offered in order %q, got %q", want, offered)
+			}
+			for i := range want {
+				if offered[i] != want[i] {
+					t.Fatalf("expected keys offered in order %q, got %q", want, offered)
+				}
+			}
+
+			if prompts != test.prompts {
+				t.Errorf("expected %d passphrase prompts, got %d", test.prompts, prompts)
+			}
+		})
+	}
+}
+
+// encryptedKeyOnly copies the encrypted test key somewhere without its public
+// half, so it has to be decrypted up front.
+func encryptedKeyOnly(t *testing.T) string {
+	t.Helper()
+
+	buffer, err := ioutil.ReadFile(filepath.Join("testdata", "testpass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "id_test")
+	if err := ioutil.WriteFile(file, buffer, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPrivateKeyFileErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		file      string
+		passwords []string
+		err       error
+		attempts  int
+	}{
+		{name: "not found", file: filepath.Join("testdata", "missing"), err: authmethod.ErrKeyNotFound},
+		{name: "unsupported", file: filepath.Join("testdata", "testnopass.pub"), err: authmethod.ErrUnsupportedKey},
+		{name: "no passphrase", file: encryptedKeyOnly(t), passwords: []string{""}, err: authmethod.ErrNoPassphrase, attempts: 1},
+		{name: "too many passphrases", file: encryptedKeyOnly(t), passwords: []string{"secret", "trustno1", "hunter2", "password"}, err: authmethod.ErrTooManyPassphrases, attempts: 3},
+	}
+
+	for _, test := range tests {
+		test := test // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var attempts int
+			method, err := authmethod.PrivateKeyFile(test.file, func(string) []byte {
+				password := test.passwords[attempts]
+				attempts++
+				return []byte(password)
+			})
+
+			if method != nil {
+				t.Error("expected no auth method")
+			}
+
+			var keyErr *authmethod.KeyError
+			if !errors.As(err, &keyErr) || keyErr.File != test.file {
+				t.Errorf("expected a KeyError for %s, got %v", test.file, err)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+
+			if attempts != test.attempts {
+				t.Errorf("expected %d attempts, got %d", test.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestNumberOfPasswordPrompts(t *testing.T) {
+	defer func(prompts int) { authmethod.NumberOfPasswordPrompts = prompts }(authmethod.NumberOfPasswordPrompts)
+	authmethod.NumberOfPasswordPrompts = 1
+
+	var attempts int
+	_, err := authmethod.PrivateKeyFile(encryptedKeyOnly(t), func(string) []byte {
+		attempts++
+		return []byte("secret")
+	})
+
+	if !errors.Is(err, authmethod.ErrTooManyPassphrases) {
+		t.Errorf("expected %v, got %v", authmethod.ErrTooManyPassphrases, err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
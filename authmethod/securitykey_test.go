@@ -0,0 +1,173 @@
+// +build !windows
+
+package authmethod_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/freman/sshcode/authmethod"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// softwareSecurityKey stands in for an agent holding a FIDO/U2F
+// sk-ssh-ed25519@openssh.com key, signing the way the hardware does.
+type softwareSecurityKey struct {
+	private     ed25519.PrivateKey
+	public      ssh.PublicKey
+	application string
+	touches     uint32
+}
+
+func newSoftwareSecurityKey(t *testing.T) *softwareSecurityKey {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There's no constructor for security keys, so go through the wire format
+	key, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, public, "ssh:"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softwareSecurityKey{private: private, public: key, application: "ssh:"}
+}
+
+func (k *softwareSecurityKey) List() ([]*agent.Key, error) {
+	return []*agent.Key{{Format: k.public.Type(), Blob: k.public.Marshal(), Comment: "software security key"}}, nil
+}
+
+func (k *softwareSecurityKey) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if string(key.Marshal()) != string(k.public.Marshal()) {
+		return nil, errors.New("unknown key")
+	}
+
+	// User presence, as if the key was touched
+	const flags = 0x01
+	k.touches++
+
+	application := sha256.Sum256([]byte(k.application))
+	message := sha256.Sum256(data)
+	signed := ssh.Marshal(struct {
+		Application []byte `ssh:"rest"`
+		Flags       byte
+		Counter     uint32
+		Message     []byte `ssh:"rest"`
+	}{application[:], flags, k.touches, message[:]})
+
+	return &ssh.Signature{
+		Format: ssh.KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(k.private, signed),
+		Rest: ssh.Marshal(struct {
+			Flags   byte
+			Counter uint32
+		}{flags, k.touches}),
+	}, nil
+}
+
+func (k *softwareSecurityKey) Add(agent.AddedKey) error   { return errors.New("not supported") }
+func (k *softwareSecurityKey) Remove(ssh.PublicKey) error { return errors.New("not supported") }
+func (k *softwareSecurityKey) RemoveAll() error           { return errors.New("not supported") }
+func (k *softwareSecurityKey) Lock([]byte) error          { return errors.New("not supported") }
+func (k *softwareSecurityKey) Unlock([]byte) error        { return errors.New("not supported") }
+func (k *softwareSecurityKey) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("not supported")
+}
+
+// serveAgent makes keys available through SSH_AUTH_SOCK for the rest of the
+// test.
+func serveAgent(t *testing.T, keys agent.Agent) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keys, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+}
+
+func TestSecurityKeyAgent(t *testing.T) {
+	securityKey := newSoftwareSecurityKey(t)
+	serveAgent(t, securityKey)
+
+	method := authmethod.SSHAgent()
+	if method == nil {
+		t.Fatal("expected an auth method")
+	}
+
+	var offered []string
+	if err := authenticate(t, publicKeyServer(securityKey.public, &offered), method); err != nil {
+		t.Fatalf("expected to authenticate with the security key, got %v", err)
+	}
+
+	if securityKey.touches != 1 {
+		t.Errorf("expected the key to be touched once, got %d", securityKey.touches)
+	}
+}
+
+func TestSecurityKeyAgentCertificate(t *testing.T) {
+	securityKey := newSoftwareSecurityKey(t)
+	serveAgent(t, securityKey)
+
+	ca := newSigner(t)
+	certFile := filepath.Join(t.TempDir(), "id_ed25519_sk-cert.pub")
+	writeCertificate(t, certFile, ca, securityKey.public)
+
+	if err := authenticate(t, certOnlyServer(ca.PublicKey()), authmethod.SSHAgent(certFile)); err != nil {
+		t.Fatalf("expected to authenticate with the certificate, got %v", err)
+	}
+}
+
+func TestSecurityKeyFile(t *testing.T) {
+	t.Parallel()
+
+	securityKey := newSoftwareSecurityKey(t)
+
+	// The private half is only a handle for the hardware
+	file := filepath.Join(t.TempDir(), "id_ed25519_sk")
+	if err := ioutil.WriteFile(file, []byte("key handle"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file+".pub", ssh.MarshalAuthorizedKey(securityKey.public), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !authmethod.IsSecurityKey(authmethod.PublicKeyFile(file)) {
+		t.Error("expected a security key")
+	}
+
+	_, err := authmethod.PrivateKeySigners(file, nil)
+	if !errors.Is(err, authmethod.ErrSecurityKey) {
+		t.Errorf("expected %v, got %v", authmethod.ErrSecurityKey, err)
+	}
+}
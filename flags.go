@@ -7,29 +7,65 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Bob-Thomas/configdir"
+	"github.com/freman/sshcode/install"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 func flags() (host string) {
 	cfgFile := pflag.StringP("config", "C", "", "Configuration file for sshcode")
-	pflag.StringP("identity", "i", "", "Identity file (eg: ~/.ssh/id_rsa")
+	pflag.StringArrayP("identity", "i", nil, "Identity file, may be repeated (eg: ~/.ssh/id_rsa)")
+	pflag.StringArray("certificatefile", nil, "User certificate, may be repeated (default <identity_file>-cert.pub)")
+	pflag.BoolP("forwardagent", "A", false, "Forward the authentication agent to the server")
+	pflag.String("identityagent", "", "Agent socket to use, or none for the built-in agent (default SSH_AUTH_SOCK)")
+	pflag.String("addkeystoagent", "", "Add decrypted identities to the agent: yes, confirm, ask or no, optionally followed by a lifetime (default no, or yes when forwarding without an agent)")
 	pflag.StringP("login", "l", "", "Login username")
 	pflag.StringP("bind", "b", "", "Bind address")
+	pflag.StringP("proxyjump", "J", "", "Jump hosts, comma separated (eg: [user@]host[:port],...)")
+	pflag.String("proxycommand", "", "Command to connect to the server through (eg: nc -X connect -x proxy:3128 %h %p)")
+	pflag.StringArrayP("localforward", "L", nil, "Local port forward, may be repeated (eg: [bind_address:]port:host:hostport)")
+	pflag.StringArrayP("remoteforward", "R", nil, "Remote port forward, may be repeated (eg: [bind_address:]port:host:hostport)")
+	pflag.StringArrayP("dynamicforward", "D", nil, "Dynamic SOCKS proxy, may be repeated (eg: [bind_address:]port)")
+	pflag.StringArray("httpproxy", nil, "HTTP proxy, may be repeated (eg: [bind_address:]port)")
+	pflag.String("preferredauthentications", "", "Authentication methods to try, in order, comma separated (default publickey,keyboard-interactive,password)")
+	pflag.Int("numberofpasswordprompts", 0, "Times to ask for a password or passphrase before giving up (default 3)")
+	pflag.StringP("ciphers", "c", "", "Ciphers in order of preference, comma separated, +, - or ^ modify the defaults")
+	pflag.String("kexalgorithms", "", "Key exchange algorithms in order of preference, comma separated, +, - or ^ modify the defaults")
+	pflag.StringP("macs", "m", "", "MAC algorithms in order of preference, comma separated, +, - or ^ modify the defaults")
+	pflag.String("hostkeyalgorithms", "", "Host key algorithms in order of preference, comma separated, +, - or ^ modify the defaults")
 	pflag.BoolP("skiphosts", "s", false, "Skip known hosts - this is insecure")
+	pflag.String("stricthostkeychecking", "", "Policy for unknown or changed host keys: yes, ask, accept-new or no (default ask)")
+	pflag.String("verifyhostkeydns", "", "Verify host keys against SSHFP records in DNS: yes, ask or no (default no)")
+	pflag.StringArray("dnsserver", nil, "Name server to look up SSHFP records with, may be repeated (default those in /etc/resolv.conf)")
+	pflag.Bool("hashknownhosts", false, "Hash host names added to known_hosts")
+	pflag.String("knownhostsfile", "", "Dedicated known hosts file used instead of the user known hosts files")
+	pflag.StringArray("userknownhostsfile", nil, "User known hosts file, may be repeated (default ~/.ssh/known_hosts, ~/.ssh/known_hosts2)")
+	pflag.StringArray("globalknownhostsfile", nil, "Global known hosts file, may be repeated (default /etc/ssh/ssh_known_hosts, /etc/ssh/ssh_known_hosts2)")
 	pflag.IntP("port", "p", 22, "Port")
+	pflag.String("codeserverversion", install.DefaultVersion, "Version of code-server to install on the server")
+	pflag.String("codeservermirror", "", "Download code-server from this mirror instead of GitHub releases (eg: https://mirror/code-server)")
+	pflag.String("codeserversha256", "", "SHA-256 of the code-server release, needed unless it's pinned for the version and platform")
+	pflag.Duration("installtimeout", 10*time.Minute, "How long downloading and installing code-server may take")
+	pflag.Duration("readytimeout", time.Minute, "How long to wait for code-server to start answering")
 
 	pflag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [-b bind_address] [-i identity_file] [user@]host[:port] [-l login_name] [-p port]\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "usage: %s [-A] [-b bind_address] [-c cipher_spec] [-i identity_file] [-D [bind_address:]port] [-J destination] [-L address] [-m mac_spec] [-R address] [user@]host[:port] [-l login_name] [-p port]\n", path.Base(os.Args[0]))
 		pflag.PrintDefaults()
 	}
 
+	pflag.CommandLine.MarkDeprecated("skiphosts", "use --stricthostkeychecking=no instead")
+
 	pflag.Parse()
-	for _, flagName := range []string{"identity", "login", "bind", "port", "skiphosts"} {
+	for _, flagName := range []string{"identity", "certificatefile", "forwardagent", "identityagent", "addkeystoagent", "login", "bind", "proxyjump", "proxycommand", "preferredauthentications", "numberofpasswordprompts", "ciphers", "kexalgorithms", "macs", "hostkeyalgorithms", "port", "skiphosts", "stricthostkeychecking", "verifyhostkeydns", "dnsserver", "hashknownhosts", "knownhostsfile", "userknownhostsfile", "globalknownhostsfile", "codeserverversion", "codeservermirror", "codeserversha256", "installtimeout", "readytimeout"} {
 		viper.BindPFlag(flagName, pflag.Lookup(flagName))
 	}
+	viper.BindPFlag("forwards", pflag.Lookup("localforward"))
+	viper.BindPFlag("remoteforwards", pflag.Lookup("remoteforward"))
+	viper.BindPFlag("dynamicforwards", pflag.Lookup("dynamicforward"))
+	viper.BindPFlag("httpproxies", pflag.Lookup("httpproxy"))
 
 	var loginPassed, portPassed, configPassed bool
 
@@ -45,6 +81,10 @@ func flags() (host string) {
 	})
 
 	viper.SetDefault("workdir", "~")
+	viper.SetDefault("userknownhostsfile", []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"})
+	viper.SetDefault("globalknownhostsfile", []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"})
+	viper.SetDefault("preferredauthentications", "publickey,keyboard-interactive,password")
+	viper.SetDefault("numberofpasswordprompts", 3)
 
 	viper.SetEnvPrefix("sshcode")
 	viper.AutomaticEnv()
@@ -66,6 +106,10 @@ func flags() (host string) {
 		}
 	}
 
+	if viper.GetBool("skiphosts") && viper.GetString("stricthostkeychecking") == "" {
+		viper.Set("stricthostkeychecking", strictNo)
+	}
+
 	arg := pflag.Arg(0)
 	if arg == "" {
 		pflag.Usage()
@@ -75,6 +119,7 @@ func flags() (host string) {
 	if i := strings.Index(arg, "@"); i >= 0 {
 		if !loginPassed {
 			viper.Set("login", arg[:i])
+			loginPassed = true
 		}
 		arg = arg[i+1:]
 	}
@@ -94,6 +139,7 @@ func flags() (host string) {
 	if !portPassed && port != "" {
 		p, _ := strconv.Atoi(port)
 		viper.Set("port", p)
+		portPassed = true
 	}
 
 	workDir := pflag.Arg(1)
@@ -102,8 +148,8 @@ func flags() (host string) {
 	}
 
 	if host == "" {
-		return arg
+		host = arg
 	}
 
-	return host
+	return applySSHConfig(host, loginPassed, portPassed)
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/freman/sshcode/tunnels"
+	"github.com/spf13/viper"
+)
+
+// splitForwardSpec splits an OpenSSH style forwarding specification on colons,
+// keeping bracketed IPv6 addresses intact.
+func splitForwardSpec(spec string) []string {
+	var (
+		fields  []string
+		field   strings.Builder
+		bracket bool
+	)
+
+	for _, r := range spec {
+		switch {
+		case r == '[' && !bracket:
+			bracket = true
+		case r == ']' && bracket:
+			bracket = false
+		case r == ':' && !bracket:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+
+	return append(fields, field.String())
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+	return p, nil
+}
+
+func isSocketPath(field string) bool {
+	return strings.ContainsRune(field, '/')
+}
+
+// parseForward parses an OpenSSH style forwarding specification of the form
+// listen:target, where listen is [bind_address:]port or a socket path and
+// target is host:hostport or a socket path.
+func parseForward(spec string) (listen, target tunnels.Endpoint, err error) {
+	fields := splitForwardSpec(spec)
+	if len(fields) < 2 {
+		return listen, target, fmt.Errorf("bad forwarding specification %q", spec)
+	}
+
+	if last := fields[len(fields)-1]; isSocketPath(last) {
+		target = tunnels.Endpoint{Network: "unix", Path: last}
+		fields = fields[:len(fields)-1]
+	} else if len(fields) >= 3 {
+		target.Network, target.Host = "tcp", fields[len(fields)-2]
+		if target.Port, err = parsePort(last); err != nil {
+			return listen, target, err
+		}
+		fields = fields[:len(fields)-2]
+	} else {
+		return listen, target, fmt.Errorf("bad forwarding specification %q", spec)
+	}
+
+	switch {
+	case len(fields) == 1 && isSocketPath(fields[0]):
+		listen = tunnels.Endpoint{Network: "unix", Path: fields[0]}
+	case len(fields) == 1:
+		listen.Network, listen.Host = "tcp", "localhost"
+		listen.Port, err = parsePort(fields[0])
+	case len(fields) == 2:
+		listen.Network, listen.Host = "tcp", fields[0]
+		if listen.Host == "*" {
+			listen.Host = ""
+		}
+		listen.Port, err = parsePort(fields[1])
+	default:
+		err = fmt.Errorf("bad forwarding specification %q", spec)
+	}
+
+	return listen, target, err
+}
+
+// parseLocalForward parses a specification as used by -L, one of
+// [bind_address:]port:host:hostport, [bind_address:]port:remote_socket,
+// local_socket:host:hostport or local_socket:remote_socket.
+func parseLocalForward(spec string) (local, remote tunnels.Endpoint, err error) {
+	return parseForward(spec)
+}
+
+// parseRemoteForward parses a specification as used by -R, one of
+// [bind_address:]port:host:hostport, [bind_address:]port:local_socket,
+// remote_socket:host:hostport or remote_socket:local_socket.
+func parseRemoteForward(spec string) (remote, local tunnels.Endpoint, err error) {
+	remote, local, err = parseForward(spec)
+	if err != nil {
+		return remote, local, err
+	}
+	if remote.Network == "tcp" && remote.Host == "" {
+		remote.Host = "0.0.0.0"
+	}
+	return remote, local, nil
+}
+
+// parseDynamicForward parses a [bind_address:]port specification as used by -D
+// and --httpproxy.
+func parseDynamicForward(spec string) (local tunnels.Endpoint, err error) {
+	fields := splitForwardSpec(spec)
+
+	switch len(fields) {
+	case 1:
+		local.Host = "localhost"
+	case 2:
+		local.Host, fields = fields[0], fields[1:]
+		if local.Host == "*" {
+			local.Host = ""
+		}
+	default:
+		return local, fmt.Errorf("bad dynamic forwarding specification %q", spec)
+	}
+
+	local.Port, err = parsePort(fields[0])
+	return local, err
+}
+
+// parseCredentials parses user:password entries as used by the socksusers
+// configuration key.
+func parseCredentials(entries []string) (tunnels.Credentials, error) {
+	credentials := tunnels.Credentials{}
+	for _, entry := range entries {
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad SOCKS user %q, expected user:password", entry)
+		}
+		credentials[entry[:i]] = entry[i+1:]
+	}
+	return credentials, nil
+}
+
+// portForwards sets up all the forwards and proxies asked for.
+func portForwards(tmgr *tunnels.Manager) error {
+	if err := localForwards(tmgr, viper.GetStringSlice("forwards")); err != nil {
+		return err
+	}
+
+	if err := remoteForwards(tmgr, viper.GetStringSlice("remoteforwards")); err != nil {
+		return err
+	}
+
+	credentials, err := parseCredentials(viper.GetStringSlice("socksusers"))
+	if err != nil {
+		return err
+	}
+
+	if err := dynamicForwards(tmgr, viper.GetStringSlice("dynamicforwards"), credentials); err != nil {
+		return err
+	}
+
+	return httpProxies(tmgr, viper.GetStringSlice("httpproxies"), credentials)
+}
+
+// localForwards sets up the fixed tunnels requested with -L or the forwards
+// configuration key.
+func localForwards(tmgr *tunnels.Manager, specs []string) error {
+	for _, spec := range specs {
+		local, remote, err := parseLocalForward(spec)
+		if err != nil {
+			return err
+		}
+
+		tunnel, err := tmgr.Fixed(spec, local, remote)
+		if err != nil {
+			return fmt.Errorf("unable to forward %s: %v", spec, err)
+		}
+
+		fmt.Printf("Forwarding %s to %s\n", tunnel.Local, tunnel.Remote)
+	}
+
+	return nil
+}
+
+// remoteForwards sets up the remote tunnels requested with -R or the
+// remoteforwards configuration key.
+func remoteForwards(tmgr *tunnels.Manager, specs []string) error {
+	for _, spec := range specs {
+		remote, local, err := parseRemoteForward(spec)
+		if err != nil {
+			return err
+		}
+
+		tunnel, err := tmgr.Remote(spec, remote, local)
+		if err != nil {
+			return fmt.Errorf("unable to forward %s: %v", spec, err)
+		}
+
+		fmt.Printf("Forwarding remote %s to %s\n", tunnel.Remote, tunnel.Local)
+	}
+
+	return nil
+}
+
+// dynamicForwards sets up the SOCKS proxies requested with -D or the
+// dynamicforwards configuration key, requiring clients to authenticate with
+// credentials when any are given.
+func dynamicForwards(tmgr *tunnels.Manager, specs []string, credentials tunnels.Credentials) error {
+	for _, spec := range specs {
+		local, err := parseDynamicForward(spec)
+		if err != nil {
+			return err
+		}
+
+		tunnel, err := tmgr.Dynamic(spec, local, credentials)
+		if err != nil {
+			return fmt.Errorf("unable to forward %s: %v", spec, err)
+		}
+
+		fmt.Printf("SOCKS and HTTP proxy listening on %s\n", tunnel.Local)
+	}
+
+	return nil
+}
+
+// httpProxies sets up the HTTP proxies requested with --httpproxy or the
+// httpproxies configuration key, requiring clients to authenticate with
+// credentials when any are given.
+func httpProxies(tmgr *tunnels.Manager, specs []string, credentials tunnels.Credentials) error {
+	for _, spec := range specs {
+		local, err := parseDynamicForward(spec)
+		if err != nil {
+			return err
+		}
+
+		tunnel, err := tmgr.HTTPProxy(spec, local, credentials)
+		if err != nil {
+			return fmt.Errorf("unable to forward %s: %v", spec, err)
+		}
+
+		fmt.Printf("HTTP proxy listening on %s\n", tunnel.Local)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/freman/sshcode/tunnels"
+)
+
+func TestSplitForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec   string
+		fields []string
+	}{
+		{"8080", []string{"8080"}},
+		{"8080:localhost:80", []string{"8080", "localhost", "80"}},
+		{"[::1]:8080:[fe80::1]:80", []string{"::1", "8080", "fe80::1", "80"}},
+		{"/tmp/local.sock:/var/run/remote.sock", []string{"/tmp/local.sock", "/var/run/remote.sock"}},
+		{"8080:", []string{"8080", ""}},
+	}
+
+	for _, test := range tests {
+		if fields := splitForwardSpec(test.spec); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%q: expected %q, got %q", test.spec, test.fields, fields)
+		}
+	}
+}
+
+func tcpEndpoint(host string, port int) tunnels.Endpoint {
+	return tunnels.Endpoint{Network: "tcp", Host: host, Port: port}
+}
+
+func unixEndpoint(path string) tunnels.Endpoint {
+	return tunnels.Endpoint{Network: "unix", Path: path}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec           string
+		listen, target tunnels.Endpoint
+		err            bool
+	}{
+		{spec: "8080:localhost:80", listen: tcpEndpoint("localhost", 8080), target: tcpEndpoint("localhost", 80)},
+		{spec: "0.0.0.0:8080:db:5432", listen: tcpEndpoint("0.0.0.0", 8080), target: tcpEndpoint("db", 5432)},
+		{spec: "*:8080:db:5432", listen: tcpEndpoint("", 8080), target: tcpEndpoint("db", 5432)},
+		{spec: ":8080:db:5432", listen: tcpEndpoint("", 8080), target: tcpEndpoint("db", 5432)},
+		{spec: "[::1]:8080:[fe80::1]:80", listen: tcpEndpoint("::1", 8080), target: tcpEndpoint("fe80::1", 80)},
+		{spec: "8080:/var/run/docker.sock", listen: tcpEndpoint("localhost", 8080), target: unixEndpoint("/var/run/docker.sock")},
+		{spec: "[::1]:8080:/var/run/docker.sock", listen: tcpEndpoint("::1", 8080), target: unixEndpoint("/var/run/docker.sock")},
+		{spec: "/tmp/db.sock:db:5432", listen: unixEndpoint("/tmp/db.sock"), target: tcpEndpoint("db", 5432)},
+		{spec: "/tmp/local.sock:/var/run/remote.sock", listen: unixEndpoint("/tmp/local.sock"), target: unixEndpoint("/var/run/remote.sock")},
+		{spec: "8080", err: true},
+		{spec: "8080:localhost", err: true},
+		{spec: "http:localhost:80", err: true},
+		{spec: "8080:localhost:http", err: true},
+		{spec: "70000:localhost:80", err: true},
+		{spec: "8080:localhost:-1", err: true},
+		{spec: "a:b:8080:localhost:80", err: true},
+	}
+
+	for _, test := range tests {
+		listen, target, err := parseForward(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v to %+v", test.spec, listen, target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if listen != test.listen || target != test.target {
+			t.Errorf("%q: expected %+v to %+v, got %+v to %+v", test.spec, test.listen, test.target, listen, target)
+		}
+	}
+}
+
+func TestParseRemoteForward(t *testing.T) {
+	tests := []struct {
+		spec          string
+		remote, local tunnels.Endpoint
+	}{
+		{"8080:localhost:80", tcpEndpoint("localhost", 8080), tcpEndpoint("localhost", 80)},
+		{"*:8080:localhost:80", tcpEndpoint("0.0.0.0", 8080), tcpEndpoint("localhost", 80)},
+		{"/tmp/remote.sock:localhost:80", unixEndpoint("/tmp/remote.sock"), tcpEndpoint("localhost", 80)},
+	}
+
+	for _, test := range tests {
+		remote, local, err := parseRemoteForward(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if remote != test.remote || local != test.local {
+			t.Errorf("%q: expected %+v to %+v, got %+v to %+v", test.spec, test.remote, test.local, remote, local)
+		}
+	}
+}
+
+func TestParseDynamicForward(t *testing.T) {
+	tests := []struct {
+		spec  string
+		local tunnels.Endpoint
+		err   bool
+	}{
+		{spec: "1080", local: tunnels.Endpoint{Host: "localhost", Port: 1080}},
+		{spec: "*:1080", local: tunnels.Endpoint{Port: 1080}},
+		{spec: "[::1]:1080", local: tunnels.Endpoint{Host: "::1", Port: 1080}},
+		{spec: "socks", err: true},
+		{spec: "99999", err: true},
+		{spec: "a:b:1080", err: true},
+	}
+
+	for _, test := range tests {
+		local, err := parseDynamicForward(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.spec, local)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if local != test.local {
+			t.Errorf("%q: expected %+v, got %+v", test.spec, test.local, local)
+		}
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	credentials, err := parseCredentials([]string{"alice:secret", "bob:pass:with:colons", "carol:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tunnels.Credentials{"alice": "secret", "bob": "pass:with:colons", "carol": ""}
+	if !reflect.DeepEqual(credentials, want) {
+		t.Errorf("expected %v, got %v", want, credentials)
+	}
+
+	for _, entry := range []string{"alice", ":secret", ""} {
+		if _, err := parseCredentials([]string{entry}); err == nil {
+			t.Errorf("%q: expected an error", entry)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostAuthority is a @cert-authority line from a known_hosts file.
+type hostAuthority struct {
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// hostAuthorities holds the @cert-authority and @revoked markers found in
+// known_hosts files.
+type hostAuthorities struct {
+	authorities []hostAuthority
+	revoked     map[string]string
+	// markers are the file:line locations of every marker line
+	markers map[string]bool
+}
+
+// loadHostAuthorities reads the markers from files, skipping any that don't
+// exist.
+func loadHostAuthorities(files ...string) (*hostAuthorities, error) {
+	h := &hostAuthorities{revoked: map[string]string{}, markers: map[string]bool{}}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for lineNum := 1; scanner.Scan(); lineNum++ {
+			line := scanner.Bytes()
+			if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("@")) {
+				continue
+			}
+
+			marker, hosts, key, _, _, err := ssh.ParseKnownHosts(line)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", file, lineNum, err)
+			}
+
+			h.markers[fmt.Sprintf("%s:%d", file, lineNum)] = true
+
+			switch marker {
+			case "cert-authority":
+				h.authorities = append(h.authorities, hostAuthority{patterns: hosts, key: key})
+			case "revoked":
+				h.revoked[string(key.Marshal())] = fmt.Sprintf("%s:%d", file, lineNum)
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// plainKeys leaves the marker lines out of the keys known for a host, as
+// knownhosts counts them along with its plain keys. A host known only by its
+// authority is then as new as any other when it offers a plain key.
+func (h *hostAuthorities) plainKeys(err *knownhosts.KeyError) *knownhosts.KeyError {
+	var want []knownhosts.KnownKey
+	for _, known := range err.Want {
+		if !h.markers[fmt.Sprintf("%s:%d", known.Filename, known.Line)] {
+			want = append(want, known)
+		}
+	}
+	return &knownhosts.KeyError{Want: want}
+}
+
+// IsHostAuthority reports whether auth is trusted to sign host certificates
+// for address.
+func (h *hostAuthorities) IsHostAuthority(auth ssh.PublicKey, address string) bool {
+	host := strings.ToLower(knownhosts.Normalize(address))
+	for _, authority := range h.authorities {
+		if bytes.Equal(authority.key.Marshal(), auth.Marshal()) && matchHostPatterns(authority.patterns, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRevoked reports whether the certificate, or the key that signed it, is
+// marked as @revoked.
+func (h *hostAuthorities) IsRevoked(cert *ssh.Certificate) bool {
+	return h.isRevokedKey(cert) || h.isRevokedKey(cert.Key) || h.isRevokedKey(cert.SignatureKey)
+}
+
+func (h *hostAuthorities) isRevokedKey(key ssh.PublicKey) bool {
+	_, revoked := h.revoked[string(key.Marshal())]
+	return revoked
+}
+
+// HostKeyCallback verifies host certificates against the known authorities,
+// leaving plain host keys to fallback.
+func (h *hostAuthorities) HostKeyCallback(fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: h.IsHostAuthority,
+		IsRevoked:       h.IsRevoked,
+		HostKeyFallback: fallback,
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if location, revoked := h.revoked[string(key.Marshal())]; revoked {
+			fmt.Printf(`
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@       WARNING: REVOKED HOST KEY DETECTED!               @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+The %s host key for %s is marked as revoked.
+This could mean that a stolen key is being used to
+impersonate this host.
+Revoked key in %s
+`[1:], key.Type(), hostname, location)
+			return fmt.Errorf("host key for %s is revoked", hostname)
+		}
+
+		cert, isCert := key.(*ssh.Certificate)
+		if !isCert {
+			return fallback(hostname, remote, key)
+		}
+
+		// Like OpenSSH, certificates from unknown authorities are checked as
+		// plain keys
+		if !h.IsHostAuthority(cert.SignatureKey, hostname) {
+			return fallback(hostname, remote, cert.Key)
+		}
+
+		err := checker.CheckHostKey(hostname, remote, key)
+		if err != nil {
+			fmt.Printf(`
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@    WARNING: HOST CERTIFICATE COULD NOT BE VERIFIED!     @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!
+The %s certificate sent by the remote host, signed by
+%s key %s,
+was rejected: %v
+Please contact your system administrator.
+`[1:], cert.Key.Type(), cert.SignatureKey.Type(), ssh.FingerprintSHA256(cert.SignatureKey), err)
+		}
+		return err
+	}
+}
+
+// matchHostPatterns matches a lowercase host against known_hosts style
+// patterns, which may be hashed, contain * and ? wildcards or be negated with
+// !.
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		// Host names are case insensitive, hashes are not
+		var match bool
+		if strings.HasPrefix(pattern, "|1|") {
+			match = matchHashedHost(pattern, host)
+		} else {
+			match = wildcardMatch(strings.ToLower(pattern), host)
+		}
+
+		if match && negated {
+			return false
+		}
+		matched = matched || match
+	}
+	return matched
+}
+
+func matchHashedHost(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// wildcardMatch matches s against a pattern where * matches any run of
+// characters and ? matches exactly one.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
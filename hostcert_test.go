@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newHostCert signs a certificate for host key with ca, valid for principals
+// until validBefore.
+func newHostCert(t *testing.T, ca, host ssh.Signer, validBefore time.Time, principals ...string) *ssh.Certificate {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             host.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestHostAuthorities(t *testing.T) {
+	ca, otherCA, host := newSigner(t), newSigner(t), newSigner(t)
+	valid := time.Now().Add(time.Hour)
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	errFallback := errors.New("unknown host key")
+
+	tests := []struct {
+		name     string
+		lines    []string
+		cert     *ssh.Certificate
+		ok       bool
+		fallback bool
+	}{
+		{
+			name:  "trusted",
+			lines: []string{"@cert-authority *.example.com " + authorizedKey(ca.PublicKey())},
+			cert:  newHostCert(t, ca, host, valid, "web.example.com"),
+			ok:    true,
+		},
+		{
+			name:  "mixed case pattern",
+			lines: []string{"@cert-authority *.Example.COM " + authorizedKey(ca.PublicKey())},
+			cert:  newHostCert(t, ca, host, valid, "web.example.com"),
+			ok:    true,
+		},
+		{
+			name:  "hashed pattern",
+			lines: []string{"@cert-authority " + knownhosts.HashHostname("web.example.com") + " " + authorizedKey(ca.PublicKey())},
+			cert:  newHostCert(t, ca, host, valid, "web.example.com"),
+			ok:    true,
+		},
+		{
+			name:  "principal mismatch",
+			lines: []string{"@cert-authority *.example.com " + authorizedKey(ca.PublicKey())},
+			cert:  newHostCert(t, ca, host, valid, "db.example.com"),
+		},
+		{
+			name:  "expired",
+			lines: []string{"@cert-authority *.example.com " + authorizedKey(ca.PublicKey())},
+			cert:  newHostCert(t, ca, host, time.Now().Add(-time.Minute), "web.example.com"),
+		},
+		{
+			name: "revoked authority",
+			lines: []string{
+				"@cert-authority *.example.com " + authorizedKey(ca.PublicKey()),
+				"@revoked * " + authorizedKey(ca.PublicKey()),
+			},
+			cert: newHostCert(t, ca, host, valid, "web.example.com"),
+		},
+		{
+			name: "revoked host key",
+			lines: []string{
+				"@cert-authority *.example.com " + authorizedKey(ca.PublicKey()),
+				"@revoked * " + authorizedKey(host.PublicKey()),
+			},
+			cert: newHostCert(t, ca, host, valid, "web.example.com"),
+		},
+		{
+			name:     "authority for another host",
+			lines:    []string{"@cert-authority *.example.org " + authorizedKey(ca.PublicKey())},
+			cert:     newHostCert(t, ca, host, valid, "web.example.com"),
+			fallback: true,
+		},
+		{
+			name:     "negated pattern",
+			lines:    []string{"@cert-authority *.example.com,!web.example.com " + authorizedKey(ca.PublicKey())},
+			cert:     newHostCert(t, ca, host, valid, "web.example.com"),
+			fallback: true,
+		},
+		{
+			name:     "unknown authority",
+			lines:    []string{"@cert-authority *.example.com " + authorizedKey(ca.PublicKey())},
+			cert:     newHostCert(t, otherCA, host, valid, "web.example.com"),
+			fallback: true,
+		},
+	}
+
+	for _, test := range tests {
+		for _, knownKey := range []bool{false, true} {
+			file := filepath.Join(t.TempDir(), "known_hosts")
+			if err := ioutil.WriteFile(file, []byte(strings.Join(test.lines, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			authorities, err := loadHostAuthorities(file, filepath.Join(t.TempDir(), "missing"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Plain keys are left to known_hosts, which may or may not
+			// know the host key
+			var fellBack bool
+			callback := authorities.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				fellBack = true
+				if hostname != "web.example.com:22" {
+					t.Errorf("%s: unexpected host name %s", test.name, hostname)
+				}
+				if _, isCert := key.(*ssh.Certificate); isCert {
+					t.Errorf("%s: expected the plain host key to be checked", test.name)
+				}
+				if knownKey {
+					return nil
+				}
+				return errFallback
+			})
+
+			err = callback("web.example.com:22", remote, test.cert)
+			if fellBack != test.fallback {
+				t.Errorf("%s: expected falling back to known_hosts to be %v", test.name, test.fallback)
+			}
+
+			ok := test.ok || test.fallback && knownKey
+			if ok && err != nil {
+				t.Errorf("%s (known key %v): expected the certificate to be accepted, got %v", test.name, knownKey, err)
+			} else if !ok && err == nil {
+				t.Errorf("%s (known key %v): expected the certificate to be refused", test.name, knownKey)
+			}
+		}
+	}
+}
+
+func TestMatchHostPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		match    bool
+	}{
+		{[]string{"web.example.com"}, "web.example.com", true},
+		{[]string{"Web.Example.com"}, "web.example.com", true},
+		{[]string{"*.example.com"}, "web.example.com", true},
+		{[]string{"web?.example.com"}, "web1.example.com", true},
+		{[]string{"web?.example.com"}, "web.example.com", false},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com", "!db.example.com"}, "db.example.com", false},
+		{[]string{"!db.example.com"}, "web.example.com", false},
+		{[]string{"[web.example.com]:2222"}, "[web.example.com]:2222", true},
+		{[]string{knownhosts.HashHostname("web.example.com")}, "web.example.com", true},
+		{[]string{knownhosts.HashHostname("web.example.com")}, "db.example.com", false},
+		{[]string{"|1|bad"}, "web.example.com", false},
+	}
+
+	for _, test := range tests {
+		if match := matchHostPatterns(test.patterns, test.host); match != test.match {
+			t.Errorf("%v against %s: expected %v, got %v", test.patterns, test.host, test.match, match)
+		}
+	}
+}
+
+func TestHostAuthorityNewHost(t *testing.T) {
+	ca, otherCA, host := newSigner(t), newSigner(t), newSigner(t)
+	line := "@cert-authority *.example.com " + authorizedKey(ca.PublicKey())
+
+	tests := []struct {
+		name string
+		key  ssh.PublicKey
+	}{
+		{"plain key", host.PublicKey()},
+		{"another authority", newHostCert(t, otherCA, host, time.Now().Add(time.Hour), "web.example.com")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Known only through its authority, the host is asked about as
+			// a new one rather than refused as changed
+			file, asked := useKnownHosts(t, "ask", true, line)
+
+			if err := KnownHostsHandler()("web.example.com:22", testRemote, test.key); err != nil {
+				t.Fatalf("expected the host to be trusted, got %v", err)
+			}
+			if *asked != 1 {
+				t.Errorf("expected to be asked once, was asked %d times", *asked)
+			}
+
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := knownhosts.Line([]string{"web.example.com"}, host.PublicKey()); !strings.Contains(string(data), want) {
+				t.Errorf("expected the plain key to be recorded, got %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// Package install puts a given version of code-server on the server,
+// downloading it locally, verifying its checksum and unpacking it over ssh.
+package install
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultVersion is the code-server release installed unless another is
+// asked for.
+const DefaultVersion = "4.103.0"
+
+// Checksums holds the SHA-256 in hex of release archives, by archive name,
+// which are trusted without a checksum being given. Those of DefaultVersion
+// belong here, taken from the release's own checksum files, and need
+// updating along with it.
+var Checksums = map[string]string{}
+
+// Dir is where releases are installed on the server, one directory per
+// version.
+const Dir = "~/.local/share/code-server"
+
+// Remote runs commands on the server through a shell.
+type Remote interface {
+	// Output runs cmd and returns what it wrote to stdout.
+	Output(cmd string) ([]byte, error)
+	// Run runs cmd with stdin as its input, giving up once ctx is done.
+	Run(ctx context.Context, cmd string, stdin io.Reader) error
+}
+
+// Installer installs Version of code-server from Source.
+type Installer struct {
+	Remote  Remote
+	Source  Source
+	Version string
+	// Checksum is the SHA-256 of the archive in hex, needed unless it's in
+	// Checksums.
+	Checksum string
+	// Client downloads releases, one with connection timeouts when nil.
+	Client *http.Client
+}
+
+// defaultClient gives up on servers that don't answer. Downloads themselves
+// are bounded by the context.
+var defaultClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+var validVersion = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+-]*$`)
+
+// Install makes sure the version is installed on the server, returning the
+// path to its code-server binary for use in shell commands.
+func (i *Installer) Install(ctx context.Context) (string, error) {
+	version := strings.TrimPrefix(i.Version, "v")
+	if !validVersion.MatchString(version) {
+		return "", fmt.Errorf("invalid code-server version %q", i.Version)
+	}
+
+	dir := Dir + "/" + version
+	binary := dir + "/bin/code-server"
+
+	installed, err := i.Remote.Output("[ -x " + binary + " ] && echo installed || true")
+	if err != nil {
+		return "", fmt.Errorf("checking for code-server %s: %w", version, err)
+	}
+	if strings.TrimSpace(string(installed)) == "installed" {
+		return binary, nil
+	}
+
+	goos, arch, err := Platform(i.Remote)
+	if err != nil {
+		return "", err
+	}
+
+	checksum := i.Checksum
+	if checksum == "" {
+		checksum = Checksums[archiveName(version, goos, arch)]
+	}
+	if checksum == "" {
+		return "", fmt.Errorf("no checksum is pinned for code-server %s on %s/%s, give one to verify it with", version, goos, arch)
+	}
+
+	url, err := i.Source.Release(ctx, version, goos, arch)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("[install] Installing code-server %s for %s/%s\n", version, goos, arch)
+
+	archive, err := i.download(ctx, url, checksum)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	// Unpack alongside and swap it in so an interrupted install isn't
+	// mistaken for a finished one
+	cmd := fmt.Sprintf(`set -e; mkdir -p %[1]s; tmp=$(mktemp -d %[1]s/.%[2]s.XXXXXX); trap 'rm -rf "$tmp"' EXIT; tar -xzf - -C "$tmp" --strip-components=1; rm -rf %[3]s; mv "$tmp" %[3]s`, Dir, version, dir)
+	if err := i.Remote.Run(ctx, cmd, archive); err != nil {
+		return "", fmt.Errorf("unpacking code-server %s: %w", version, err)
+	}
+
+	return binary, nil
+}
+
+// download fetches url into a temporary file, checking it against checksum.
+// The file is left ready to be read from the start.
+func (i *Installer) download(ctx context.Context, url, checksum string) (*os.File, error) {
+	client := i.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	file, err := ioutil.TempFile("", "code-server-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("downloading %s: %w", url, err)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("checksum mismatch for %s: got %s, expected %s", url, sum, checksum)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// Platform returns the server's operating system and architecture as
+// code-server names them in its releases.
+func Platform(remote Remote) (goos, arch string, err error) {
+	out, err := remote.Output("uname -sm")
+	if err != nil {
+		return "", "", fmt.Errorf("detecting the server platform: %w", err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected uname output %q", out)
+	}
+
+	switch fields[0] {
+	case "Linux":
+		goos = "linux"
+	case "Darwin":
+		goos = "macos"
+	default:
+		return "", "", fmt.Errorf("code-server isn't available for %s", fields[0])
+	}
+
+	switch fields[1] {
+	case "x86_64", "amd64":
+		arch = "amd64"
+	case "aarch64", "arm64":
+		arch = "arm64"
+	case "armv7l":
+		arch = "armv7l"
+	default:
+		return "", "", fmt.Errorf("code-server isn't available for %s on %s", fields[0], fields[1])
+	}
+
+	return goos, arch, nil
+}
@@ -0,0 +1,371 @@
+package install_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/install"
+)
+
+// localRemote runs commands with a shell on this machine, with home as the
+// home directory, pretending to be uname.
+type localRemote struct {
+	home  string
+	uname string
+}
+
+func (r *localRemote) command(ctx context.Context, cmd string) *exec.Cmd {
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	c.Env = append(os.Environ(), "HOME="+r.home)
+	c.Stderr = os.Stderr
+	return c
+}
+
+func (r *localRemote) Output(cmd string) ([]byte, error) {
+	if cmd == "uname -sm" {
+		return []byte(r.uname + "\n"), nil
+	}
+	return r.command(context.Background(), cmd).Output()
+}
+
+func (r *localRemote) Run(ctx context.Context, cmd string, stdin io.Reader) error {
+	c := r.command(ctx, cmd)
+	c.Stdin = stdin
+	return c.Run()
+}
+
+// archive builds a release tarball holding a code-server script.
+func archive(t *testing.T, version, goos, arch string) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gz)
+
+	script := []byte("#!/bin/sh\necho code-server " + version + "\n")
+	top := "code-server-" + version + "-" + goos + "-" + arch
+	for _, hdr := range []*tar.Header{
+		{Name: top + "/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: top + "/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: top + "/bin/code-server", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(script))},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tw.Write(script); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// mirror serves files by path, counting requests for archives.
+func mirror(t *testing.T, files map[string][]byte) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, found := files[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".tar.gz") {
+			atomic.AddInt32(&downloads, 1)
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server, &downloads
+}
+
+func TestInstall(t *testing.T) {
+	t.Parallel()
+
+	release := archive(t, "4.0.0", "linux", "arm64")
+	name := "code-server-4.0.0-linux-arm64.tar.gz"
+	server, downloads := mirror(t, map[string][]byte{
+		"/4.0.0/" + name: release,
+	})
+
+	remote := &localRemote{home: t.TempDir(), uname: "Linux aarch64"}
+	installer := &install.Installer{
+		Remote:   remote,
+		Source:   &install.Mirror{URL: server.URL},
+		Version:  "v4.0.0",
+		Checksum: checksum(release),
+	}
+
+	binary, err := installer.Install(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary != "~/.local/share/code-server/4.0.0/bin/code-server" {
+		t.Errorf("unexpected binary %s", binary)
+	}
+
+	out, err := remote.Output(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "code-server 4.0.0\n" {
+		t.Errorf("unexpected output from the installed binary: %q", out)
+	}
+
+	// Nothing is left behind from unpacking
+	entries, err := ioutil.ReadDir(filepath.Join(remote.home, ".local", "share", "code-server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "4.0.0" {
+		t.Errorf("expected only the 4.0.0 directory, got %v", entries)
+	}
+
+	// Installed versions aren't fetched again
+	if _, err := installer.Install(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(downloads); n != 1 {
+		t.Errorf("expected a single download, got %d", n)
+	}
+}
+
+func TestInstallChecksum(t *testing.T) {
+	t.Parallel()
+
+	release := archive(t, "4.0.0", "linux", "amd64")
+	name := "code-server-4.0.0-linux-amd64.tar.gz"
+	// The mirror's own checksum file isn't trusted
+	server, _ := mirror(t, map[string][]byte{
+		"/4.0.0/" + name:             release,
+		"/4.0.0/" + name + ".sha256": []byte(checksum(release) + "  " + name + "\n"),
+	})
+
+	tests := []struct {
+		name     string
+		checksum string
+		err      string
+	}{
+		{"missing", "", "no checksum"},
+		{"mismatch", checksum([]byte("something else")), "checksum mismatch"},
+		{"pinned", strings.ToUpper(checksum(release)), ""},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			remote := &localRemote{home: t.TempDir(), uname: "Linux x86_64"}
+			installer := &install.Installer{
+				Remote:   remote,
+				Source:   &install.Mirror{URL: server.URL},
+				Version:  "4.0.0",
+				Checksum: test.checksum,
+			}
+
+			_, err := installer.Install(context.Background())
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+			if _, err := os.Stat(filepath.Join(remote.home, ".local", "share", "code-server", "4.0.0")); !os.IsNotExist(err) {
+				t.Errorf("expected nothing to be installed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInstallPinned(t *testing.T) {
+	release := archive(t, "4.0.0", "macos", "arm64")
+	name := "code-server-4.0.0-macos-arm64.tar.gz"
+	server, _ := mirror(t, map[string][]byte{
+		"/4.0.0/" + name: release,
+	})
+
+	// Not parallel, as Checksums is shared
+	install.Checksums[name] = checksum(release)
+	defer delete(install.Checksums, name)
+
+	remote := &localRemote{home: t.TempDir(), uname: "Darwin arm64"}
+	installer := &install.Installer{
+		Remote:  remote,
+		Source:  &install.Mirror{URL: server.URL},
+		Version: "4.0.0",
+	}
+	if _, err := installer.Install(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other platforms aren't pinned
+	installer.Remote = &localRemote{home: t.TempDir(), uname: "Darwin x86_64"}
+	if _, err := installer.Install(context.Background()); err == nil || !strings.Contains(err.Error(), "no checksum") {
+		t.Errorf("expected an error about the missing checksum, got %v", err)
+	}
+}
+
+func TestInstallVersion(t *testing.T) {
+	t.Parallel()
+
+	installer := &install.Installer{
+		Remote:  &localRemote{home: t.TempDir(), uname: "Linux x86_64"},
+		Source:  &install.Mirror{URL: "http://127.0.0.1:0"},
+		Version: "4.0.0; rm -rf /",
+	}
+	if _, err := installer.Install(context.Background()); err == nil {
+		t.Error("expected an invalid version to be refused")
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		uname, goos, arch string
+	}{
+		{"Linux x86_64", "linux", "amd64"},
+		{"Linux aarch64", "linux", "arm64"},
+		{"Linux armv7l", "linux", "armv7l"},
+		{"Darwin arm64", "macos", "arm64"},
+		{"Darwin x86_64", "macos", "amd64"},
+		{"FreeBSD amd64", "", ""},
+		{"Linux mips", "", ""},
+	}
+
+	for _, test := range tests {
+		goos, arch, err := install.Platform(&localRemote{uname: test.uname})
+		if test.goos == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s/%s", test.uname, goos, arch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.uname, err)
+			continue
+		}
+		if goos != test.goos || arch != test.arch {
+			t.Errorf("%s: expected %s/%s, got %s/%s", test.uname, test.goos, test.arch, goos, arch)
+		}
+	}
+}
+
+func TestGitHub(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/coder/code-server/releases/tags/v4.0.0" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"assets": []map[string]string{
+				{"name": "code-server-4.0.0-linux-amd64.tar.gz", "browser_download_url": "https://example.com/amd64.tar.gz", "digest": "sha256:abc123"},
+				{"name": "code-server-4.0.0-linux-arm64.tar.gz", "browser_download_url": "https://example.com/arm64.tar.gz"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	source := &install.GitHub{API: server.URL}
+
+	url, err := source.Release(context.Background(), "4.0.0", "linux", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://example.com/amd64.tar.gz" {
+		t.Errorf("unexpected release %s", url)
+	}
+
+	if _, err := source.Release(context.Background(), "4.0.0", "macos", "arm64"); err == nil {
+		t.Error("expected an error for a missing platform")
+	}
+
+	if _, err := source.Release(context.Background(), "5.0.0", "linux", "amd64"); err == nil {
+		t.Error("expected an error for a missing version")
+	}
+}
+
+func TestMirrorUnavailable(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	installer := &install.Installer{
+		Remote:   &localRemote{home: t.TempDir(), uname: "Linux x86_64"},
+		Source:   &install.Mirror{URL: server.URL},
+		Version:  "4.0.0",
+		Checksum: checksum([]byte("release")),
+	}
+	if _, err := installer.Install(context.Background()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the mirror's error, got %v", err)
+	}
+}
+
+func TestInstallTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Answers, then stalls partway through the archive
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	installer := &install.Installer{
+		Remote:   &localRemote{home: t.TempDir(), uname: "Linux x86_64"},
+		Source:   &install.Mirror{URL: server.URL},
+		Version:  "4.0.0",
+		Checksum: checksum([]byte("release")),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := installer.Install(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the download to time out, got %v", err)
+	}
+}
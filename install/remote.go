@@ -0,0 +1,59 @@
+package install
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH runs commands on the server over its own sessions on Client.
+type SSH struct {
+	Client *ssh.Client
+}
+
+func (r *SSH) Output(cmd string) ([]byte, error) {
+	session, err := r.Client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return session.Output(cmd)
+}
+
+// Run gives up on cmd when ctx is done, closing its session.
+func (r *SSH) Run(ctx context.Context, cmd string, stdin io.Reader) error {
+	session, err := r.Client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stderr = &stderr
+
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
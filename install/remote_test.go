@@ -0,0 +1,124 @@
+package install_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/install"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHRemote starts an in-process ssh server whose exec requests read all
+// their input then fail with a message on stderr, except for "stall" which
+// never finishes.
+func newSSHRemote(t *testing.T) *install.SSH {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		go ssh.DiscardRequests(reqs)
+
+		for newChan := range chans {
+			channel, requests, err := newChan.Accept()
+			if err != nil {
+				continue
+			}
+			go serveExec(channel, requests)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return &install.SSH{Client: client}
+}
+
+func serveExec(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		var msg struct{ Command string }
+		ssh.Unmarshal(req.Payload, &msg)
+		if msg.Command == "stall" {
+			// Until the session is closed
+			io.Copy(ioutil.Discard, channel)
+			return
+		}
+
+		io.Copy(ioutil.Discard, channel)
+		channel.Stderr().Write([]byte("failed\n"))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+		return
+	}
+}
+
+func TestSSHRun(t *testing.T) {
+	t.Parallel()
+
+	remote := newSSHRemote(t)
+
+	err := remote.Run(context.Background(), "fail", strings.NewReader("input"))
+	if err == nil || !strings.HasSuffix(err.Error(), ": failed") {
+		t.Errorf("expected the command's stderr in the error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Input that never ends, like a stalled unpack
+	stdin, writer := io.Pipe()
+	defer writer.Close()
+
+	start := time.Now()
+	if err := remote.Run(ctx, "stall", stdin); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the command to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the command to be given up on promptly, took %v", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+package install
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Source says where code-server releases come from. Archives are only
+// trusted by their pinned or given checksum, never one from the source.
+type Source interface {
+	// Release returns the URL of the archive of version for goos and arch.
+	Release(ctx context.Context, version, goos, arch string) (url string, err error)
+}
+
+func archiveName(version, goos, arch string) string {
+	return fmt.Sprintf("code-server-%s-%s-%s.tar.gz", version, goos, arch)
+}
+
+// GitHub finds releases through the GitHub API.
+type GitHub struct {
+	// Repo is the owner/name of the repository, coder/code-server when
+	// empty.
+	Repo string
+	// API is the base URL of the GitHub API, https://api.github.com when
+	// empty.
+	API string
+	// Client makes requests to the API, one with connection timeouts when
+	// nil.
+	Client *http.Client
+}
+
+func (g *GitHub) Release(ctx context.Context, version, goos, arch string) (string, error) {
+	repo, api, client := g.Repo, g.API, g.Client
+	if repo == "" {
+		repo = "coder/code-server"
+	}
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	if client == nil {
+		client = defaultClient
+	}
+
+	url := strings.TrimSuffix(api, "/") + "/repos/" + repo + "/releases/tags/v" + version
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("looking up code-server %s: %s", version, resp.Status)
+	}
+
+	var release struct {
+		Assets []struct {
+			Name               string `json:"name"`
+			BrowserDownloadURL string `json:"browser_download_url"`
+		} `json:"assets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", fmt.Errorf("looking up code-server %s: %w", version, err)
+	}
+
+	name := archiveName(version, goos, arch)
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset.BrowserDownloadURL, nil
+		}
+	}
+	return "", fmt.Errorf("code-server %s has no release for %s/%s", version, goos, arch)
+}
+
+// Mirror downloads releases laid out as URL/<version>/<archive>.
+type Mirror struct {
+	URL string
+}
+
+func (m *Mirror) Release(ctx context.Context, version, goos, arch string) (string, error) {
+	return strings.TrimSuffix(m.URL, "/") + "/" + version + "/" + archiveName(version, goos, arch), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/freman/sshcode/authmethod"
+	"github.com/freman/sshcode/sshfp"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// StrictHostKeyChecking policies, as in OpenSSH
+const (
+	strictYes       = "yes"
+	strictAsk       = "ask"
+	strictAcceptNew = "accept-new"
+	strictNo        = "no"
+)
+
+// strictHostKeyChecking returns the configured policy for unknown and changed
+// host keys, defaulting to asking like OpenSSH.
+func strictHostKeyChecking() (string, error) {
+	switch policy := strings.ToLower(viper.GetString("stricthostkeychecking")); policy {
+	case "":
+		return strictAsk, nil
+	case "off":
+		return strictNo, nil
+	case strictYes, strictAsk, strictAcceptNew, strictNo:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported StrictHostKeyChecking %q, expected one of yes, ask, accept-new or no", policy)
+	}
+}
+
+// verifyHostKeyDNS wraps callback to first check host keys against SSHFP
+// records when VerifyHostKeyDNS is enabled.
+func verifyHostKeyDNS(callback ssh.HostKeyCallback) (ssh.HostKeyCallback, error) {
+	switch policy := strings.ToLower(viper.GetString("verifyhostkeydns")); policy {
+	case "", "no":
+		return callback, nil
+	case "yes", "ask":
+		servers := viper.GetStringSlice("dnsserver")
+		if len(servers) == 0 {
+			var err error
+			if servers, err = sshfp.SystemServers(); err != nil {
+				return nil, fmt.Errorf("VerifyHostKeyDNS needs name servers, give them with --dnsserver: %v", err)
+			}
+		}
+
+		verifier := &sshfp.Verifier{
+			Resolver: &sshfp.DNSResolver{Servers: servers},
+			Confirm:  policy == "ask",
+		}
+		return verifier.HostKeyCallback(callback), nil
+	default:
+		return nil, fmt.Errorf("unsupported VerifyHostKeyDNS %q, expected one of yes, ask or no", policy)
+	}
+}
+
+// knownHostsFiles returns the existing known_hosts files to check host keys
+// against and the file new host keys are added to. A dedicated knownhostsfile
+// replaces the user files entirely, which is handy for CI.
+func knownHostsFiles() (files []string, userFile string) {
+	userFiles := viper.GetStringSlice("userknownhostsfile")
+	if file := viper.GetString("knownhostsfile"); file != "" {
+		userFiles = []string{file}
+	}
+
+	for _, file := range append(userFiles, viper.GetStringSlice("globalknownhostsfile")...) {
+		file = expandHome(file)
+		if _, err := os.Stat(file); err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Ignoring known hosts file %s: %v\n", file, err)
+			}
+			continue
+		}
+		files = append(files, file)
+	}
+
+	if len(userFiles) > 0 {
+		userFile = expandHome(userFiles[0])
+	}
+
+	return files, userFile
+}
+
+// confirm asks a yes/no question on the terminal until it gets an answer.
+var confirm = authmethod.PromptConfirm
+
+// unknownHost decides whether to trust a host that isn't in known_hosts,
+// recording its key when it is trusted.
+func unknownHost(policy, knownHostsFile, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	switch policy {
+	case strictYes:
+		fmt.Printf("No %s host key is known for %s and you have requested strict checking.\n", key.Type(), hostname)
+		return fmt.Errorf("host key verification failed for %s", hostname)
+	case strictAsk:
+		fmt.Printf(`
+The authenticity of host '%s (%s)' can't be established.
+%s key fingerprint is %s.
+`[1:], hostname, remote, key.Type(), ssh.FingerprintSHA256(key))
+		if !confirm("Are you sure you want to continue connecting (yes/no)? ") {
+			return fmt.Errorf("host key verification failed for %s", hostname)
+		}
+	}
+
+	if err := addKnownHost(knownHostsFile, hostname, key, viper.GetBool("hashknownhosts")); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add the host to the list of known hosts (%s): %v\n", knownHostsFile, err)
+		return nil
+	}
+
+	fmt.Printf("Warning: Permanently added '%s' (%s) to the list of known hosts.\n", hostname, key.Type())
+	return nil
+}
+
+// hostKeyChanged is set once a changed host key is let through, turning off
+// whatever a man in the middle could make use of, as OpenSSH does.
+var hostKeyChanged bool
+
+// changedHost warns that the key of a known host has changed, refusing it
+// unless StrictHostKeyChecking is off.
+func changedHost(policy, knownHostsFile string, key ssh.PublicKey, err *knownhosts.KeyError) error {
+	head := fmt.Sprintf(`
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!
+Someone could be eavesdropping on you right now (man-in-the-middle attack)!
+It is also possible that a host key has just been changed.
+The fingerprint for the %s key sent by the remote host is
+%s.
+Please contact your system administrator.
+Add correct host key in %s to get rid of this message.
+`[1:], key.Type(), ssh.FingerprintSHA256(key), knownHostsFile)
+
+	var typeKey *knownhosts.KnownKey
+	for i, knownKey := range err.Want {
+		if knownKey.Key.Type() == key.Type() {
+			typeKey = &err.Want[i]
+		}
+	}
+
+	var tail string
+	if typeKey != nil {
+		tail = fmt.Sprintf(
+			"Offending %s key in %s:%d",
+			typeKey.Key.Type(),
+			typeKey.Filename,
+			typeKey.Line,
+		)
+	} else {
+		tail = "Host was previously using different host key algorithms:"
+		for _, knownKey := range err.Want {
+			tail += fmt.Sprintf(
+				"\n - %s key in %s:%d",
+				knownKey.Key.Type(),
+				knownKey.Filename,
+				knownKey.Line,
+			)
+		}
+	}
+	fmt.Println(head + tail)
+
+	if policy == strictNo {
+		fmt.Println("StrictHostKeyChecking is disabled, continuing anyway.")
+		fmt.Println("Password and keyboard-interactive authentication, agent forwarding and port forwarding are disabled to avoid man-in-the-middle attacks.")
+		hostKeyChanged = true
+		authmethod.DisableInteractive = true
+		return nil
+	}
+	return err
+}
+
+// addKnownHost appends key for hostname to file, creating it if needed.
+func addKnownHost(file, hostname string, key ssh.PublicKey, hashed bool) error {
+	address := knownhosts.Normalize(hostname)
+	if hashed {
+		address = knownhosts.HashHostname(address)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{address}, key))
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useKnownHosts points host key checking at a known_hosts file in a temporary
+// directory, holding lines, and answers any question with answer.
+func useKnownHosts(t *testing.T, policy string, answer bool, lines ...string) (file string, asked *int) {
+	t.Helper()
+
+	file = filepath.Join(t.TempDir(), "known_hosts")
+	if len(lines) > 0 {
+		if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	asked = new(int)
+	previous := confirm
+	confirm = func(string) bool {
+		*asked++
+		return answer
+	}
+
+	viper.Reset()
+	viper.Set("knownhostsfile", file)
+	viper.Set("stricthostkeychecking", policy)
+	t.Cleanup(func() {
+		confirm = previous
+		viper.Reset()
+	})
+
+	return file, asked
+}
+
+var testRemote = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+func TestKnownHostsFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, name := range []string{"known_hosts", "dedicated", "ssh_known_hosts"} {
+		if err := ioutil.WriteFile(filepath.Join(home, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string {
+		return filepath.Join(home, name)
+	}
+
+	tests := []struct {
+		name      string
+		dedicated string
+		user      []string
+		global    []string
+		files     []string
+		userFile  string
+	}{
+		{
+			name:     "user and global",
+			user:     []string{"~/known_hosts"},
+			global:   []string{path("ssh_known_hosts")},
+			files:    []string{path("known_hosts"), path("ssh_known_hosts")},
+			userFile: path("known_hosts"),
+		},
+		{
+			name:     "missing files skipped",
+			user:     []string{"~/known_hosts", "~/known_hosts2"},
+			global:   []string{path("ssh_known_hosts"), path("ssh_known_hosts2")},
+			files:    []string{path("known_hosts"), path("ssh_known_hosts")},
+			userFile: path("known_hosts"),
+		},
+		{
+			name:     "new keys go to the first user file",
+			user:     []string{"~/known_hosts2", "~/known_hosts"},
+			global:   []string{path("ssh_known_hosts")},
+			files:    []string{path("known_hosts"), path("ssh_known_hosts")},
+			userFile: path("known_hosts2"),
+		},
+		{
+			name:      "dedicated file replaces user files",
+			dedicated: "~/dedicated",
+			user:      []string{"~/known_hosts"},
+			global:    []string{path("ssh_known_hosts")},
+			files:     []string{path("dedicated"), path("ssh_known_hosts")},
+			userFile:  path("dedicated"),
+		},
+		{
+			name:   "global only",
+			global: []string{path("ssh_known_hosts")},
+			files:  []string{path("ssh_known_hosts")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Reset()
+			defer viper.Reset()
+			viper.Set("knownhostsfile", test.dedicated)
+			viper.Set("userknownhostsfile", test.user)
+			viper.Set("globalknownhostsfile", test.global)
+
+			files, userFile := knownHostsFiles()
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("expected files %v, got %v", test.files, files)
+			}
+			if userFile != test.userFile {
+				t.Errorf("expected new keys to go to %q, got %q", test.userFile, userFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/freman/sshcode/authmethod"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostsUnknownHost(t *testing.T) {
+	tests := []struct {
+		policy string
+		answer bool
+		asked  int
+		ok     bool
+	}{
+		{policy: "yes"},
+		{policy: "ask", answer: true, asked: 1, ok: true},
+		{policy: "ask", asked: 1},
+		{policy: "", answer: true, asked: 1, ok: true},
+		{policy: "accept-new", ok: true},
+		{policy: "no", ok: true},
+		{policy: "off", ok: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			file, asked := useKnownHosts(t, test.policy, test.answer)
+			key := newSigner(t).PublicKey()
+
+			err := KnownHostsHandler()("server.example:22", testRemote, key)
+			if test.ok && err != nil {
+				t.Fatalf("expected the host to be trusted, got %v", err)
+			} else if !test.ok && err == nil {
+				t.Fatal("expected the host to be refused")
+			}
+			if *asked != test.asked {
+				t.Errorf("expected to be asked %d times, was asked %d", test.asked, *asked)
+			}
+
+			_, statErr := os.Stat(file)
+			if !test.ok {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("expected nothing to be recorded, got %v", statErr)
+				}
+				return
+			}
+
+			// Once recorded the host is known, whatever the policy
+			viper.Set("stricthostkeychecking", "yes")
+			if err := KnownHostsHandler()("server.example:22", testRemote, key); err != nil {
+				t.Errorf("expected the recorded key to be trusted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestKnownHostsChangedKey(t *testing.T) {
+	known := newSigner(t).PublicKey()
+	line := knownhosts.Line([]string{"server.example"}, known)
+
+	tests := []struct {
+		policy string
+		ok     bool
+	}{
+		{policy: "yes"},
+		{policy: "ask"},
+		{policy: "accept-new"},
+		{policy: "no", ok: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			file, asked := useKnownHosts(t, test.policy, true, line)
+			defer func() {
+				hostKeyChanged = false
+				authmethod.DisableInteractive = false
+			}()
+
+			err := KnownHostsHandler()("server.example:22", testRemote, newSigner(t).PublicKey())
+			if test.ok && err != nil {
+				t.Errorf("expected the changed key to be let through, got %v", err)
+			} else if !test.ok && err == nil {
+				t.Error("expected the changed key to be refused")
+			}
+			if *asked != 0 {
+				t.Errorf("expected not to be asked about a changed key, was asked %d times", *asked)
+			}
+			if hostKeyChanged != test.ok || authmethod.DisableInteractive != test.ok {
+				t.Errorf("expected everything a man in the middle could use to be disabled only when let through, got %v and %v", hostKeyChanged, authmethod.DisableInteractive)
+			}
+
+			// The known key is left for the user to sort out
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != line+"\n" {
+				t.Errorf("expected known_hosts to be left alone, got %q", data)
+			}
+		})
+	}
+}
+
+func TestKnownHostsHashed(t *testing.T) {
+	for _, hashed := range []bool{false, true} {
+		file, _ := useKnownHosts(t, "accept-new", false)
+		viper.Set("hashknownhosts", hashed)
+		key := newSigner(t).PublicKey()
+
+		if err := KnownHostsHandler()("server.example:2222", testRemote, key); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(data), "|1|") != hashed {
+			t.Errorf("hashed %v: unexpected entry %q", hashed, data)
+		}
+		if strings.Contains(string(data), "server.example") == hashed {
+			t.Errorf("hashed %v: unexpected entry %q", hashed, data)
+		}
+
+		viper.Set("stricthostkeychecking", "yes")
+		if err := KnownHostsHandler()("server.example:2222", testRemote, key); err != nil {
+			t.Errorf("hashed %v: expected the recorded key to be trusted, got %v", hashed, err)
+		}
+		if err := KnownHostsHandler()("server.example:22", testRemote, key); err == nil {
+			t.Errorf("hashed %v: expected the key to be recorded for port 2222 only", hashed)
+		}
+	}
+}
+
+func TestKnownHostsRecordsToUserFile(t *testing.T) {
+	useKnownHosts(t, "accept-new", false)
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "known_hosts"), filepath.Join(dir, "known_hosts2")
+	global := filepath.Join(dir, "ssh_known_hosts")
+	if err := ioutil.WriteFile(global, []byte(knownhosts.Line([]string{"other.example"}, newSigner(t).PublicKey())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("knownhostsfile", "")
+	viper.Set("userknownhostsfile", []string{first, second})
+	viper.Set("globalknownhostsfile", []string{global})
+
+	key := newSigner(t).PublicKey()
+	if err := KnownHostsHandler()("server.example:22", testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(first)
+	if err != nil {
+		t.Fatalf("expected the key to be recorded in the first user file: %v", err)
+	}
+	if want := knownhosts.Line([]string{"server.example"}, key); !strings.Contains(string(data), want) {
+		t.Errorf("expected %q to be recorded, got %q", want, data)
+	}
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Errorf("expected the second user file to be left alone, got %v", err)
+	}
+}
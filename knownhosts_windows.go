@@ -1,14 +1,64 @@
 package main
 
 import (
+	"errors"
+	"net"
+
 	"github.com/freman/putty_hosts"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func KnownHostsHandler() ssh.HostKeyCallback {
+	policy, err := strictHostKeyChecking()
+	if err != nil {
+		panic(err)
+	}
+
 	cb, err := putty_hosts.KnownHosts()
 	if err != nil {
 		panic(err)
 	}
-	return cb
+
+	// Keys are also taken from any OpenSSH style known_hosts files, along with
+	// the host certificates PuTTY has no notion of
+	files, knownHostsFile := knownHostsFiles()
+	hosts, err := knownhosts.New(files...)
+	if err != nil {
+		panic(err)
+	}
+
+	authorities, err := loadHostAuthorities(files...)
+	if err != nil {
+		panic(err)
+	}
+
+	callback, err := verifyHostKeyDNS(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		puttyErr := cb(hostname, remote, key)
+		if puttyErr == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if err := hosts(hostname, remote, key); !errors.As(err, &keyErr) {
+			return err
+		}
+		keyErr = authorities.plainKeys(keyErr)
+		if len(keyErr.Want) == 0 {
+			// Neither knows the host, unless PuTTY has a different key
+			errors.As(puttyErr, &keyErr)
+		}
+		if len(keyErr.Want) > 0 {
+			return changedHost(policy, knownHostsFile, key, keyErr)
+		}
+
+		// PuTTY's cache isn't ours to write to, so new keys are recorded in
+		// known_hosts
+		return unknownHost(policy, knownHostsFile, hostname, remote, key)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return authorities.HostKeyCallback(callback)
 }
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"path"
-	"time"
+	"os"
+	"strings"
 
 	"github.com/freman/sshcode/authmethod"
+	"github.com/freman/sshcode/install"
+	"github.com/freman/sshcode/probe"
 	"github.com/freman/sshcode/sessions"
 	"github.com/freman/sshcode/tunnels"
 	"github.com/google/uuid"
@@ -17,29 +20,30 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-const codeServerPath = "/tmp/codessh-code-server"
-
 func main() {
 	host := flags()
 	addr := fmt.Sprintf("%s:%d", host, viper.GetInt("port"))
 	login := viper.GetString("login")
 
-	var authMethods []ssh.AuthMethod
-	if sshAgent := authmethod.SSHAgent(); sshAgent != nil {
-		authMethods = append(authMethods, sshAgent)
+	algorithms, hostKeyAlgorithms, err := sshAlgorithms()
+	if err != nil {
+		log.Fatal(err)
 	}
-	if fileName := viper.GetString("identity"); fileName != "" {
-		authMethods = append(authMethods, authmethod.PrivateKeyFile(fileName, authmethod.PromptPassword))
+
+	if prompts := viper.GetInt("numberofpasswordprompts"); prompts > 0 {
+		authmethod.NumberOfPasswordPrompts = prompts
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            login,
-		Auth:            authMethods,
-		HostKeyCallback: KnownHostsHandler(),
+	if err := agentOptions(); err != nil {
+		log.Fatal(err)
 	}
 
-	if viper.GetBool("skiphosts") {
-		sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	sshConfig := &ssh.ClientConfig{
+		Config:            algorithms,
+		User:              login,
+		Auth:              authMethods(login, host, viper.GetStringSlice("identityfiles"), viper.GetStringSlice("certificatefiles"), viper.GetBool("identitiesonly")),
+		HostKeyCallback:   KnownHostsHandler(),
+		HostKeyAlgorithms: hostKeyAlgorithms,
 	}
 
 	connection, err := dial("tcp", addr, sshConfig)
@@ -50,10 +54,30 @@ func main() {
 	mgr := sessions.NewManager(connection)
 	go mgr.Run()
 
-	upgrade(mgr)
+	if viper.GetBool("forwardagent") {
+		if hostKeyChanged {
+			fmt.Fprintln(os.Stderr, "Agent forwarding is disabled as the host key has changed")
+		} else if authmethod.SystemAgent() == nil && authmethod.AddKeysToAgent == nil {
+			fmt.Fprintln(os.Stderr, "Warning: no agent to forward")
+		} else if err := mgr.ForwardAgent(authmethod.Agent()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	codeServer, err := installCodeServer(connection)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	tmgr := tunnels.NewManager(connection)
 	go tmgr.Run()
+	defer tmgr.Close()
+
+	if hostKeyChanged {
+		fmt.Fprintln(os.Stderr, "Port forwarding is disabled as the host key has changed")
+	} else if err := portForwards(tmgr); err != nil {
+		log.Fatal(err)
+	}
 
 	rand, _ := uuid.NewRandom()
 	socketName := "/tmp/code-server." + rand.String() + ".sock"
@@ -63,37 +87,56 @@ func main() {
 		log.Fatalf("Unable to create session: %v", err)
 	}
 
-	go session.Run(codeServerPath + " " + viper.GetString("workdir") + " --allow-http --no-auth --socket " + socketName)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- session.Run(codeServer + " --auth none --socket " + socketName + " " + viper.GetString("workdir"))
+	}()
 
-	// todo, probe for service status
+	if err := waitForCodeServer(connection, socketName, exited); err != nil {
+		log.Fatal(err)
+	}
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	tunnel, err := tmgr.Fixed("code-server",
+		tunnels.Endpoint{Network: "tcp", Host: "127.0.0.1"},
+		tunnels.Endpoint{Network: "unix", Path: socketName},
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer listener.Close()
+	go launchUI(mgr, "http://"+tunnel.Local.String())
 
-	go launchUI(mgr, "http://"+listener.Addr().String())
+	<-exited
+	cleanup(mgr, socketName)
+}
+
+// waitForCodeServer polls code-server's socket until it answers, giving up
+// after readytimeout or when the process exits.
+func waitForCodeServer(connection *ssh.Client, socketName string, exited <-chan error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("readytimeout"))
+	defer cancel()
 
+	ready := make(chan error, 1)
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			go forward(connection, conn, socketName)
-		}
+		ready <- (&probe.Prober{Dialer: connection}).Wait(ctx, "unix", socketName)
 	}()
 
-	session.Wait()
-	cleanup(mgr, socketName)
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("code-server didn't become ready: %w", err)
+		}
+		return nil
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("code-server exited before it was ready: %w", err)
+		}
+		return errors.New("code-server exited before it was ready")
+	}
 }
 
 func launchUI(mgr *sessions.Manager, url string) {
 	go func() {
-		time.Sleep(5 * time.Second)
-
 		ui, _ := lorca.New(url, "", 480, 320)
 		defer ui.Close()
 
@@ -103,54 +146,223 @@ func launchUI(mgr *sessions.Manager, url string) {
 	}()
 }
 
-func dial(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	if bindAddr := viper.GetString("bind"); bindAddr != "" {
-		tcpAddr, err := net.ResolveTCPAddr("tcp", bindAddr)
-		if err != nil {
-			return nil, err
+// authMethods returns the ways to authenticate user on host, in the order
+// given by PreferredAuthentications.
+func authMethods(user, host string, identityFiles, certificateFiles []string, identitiesOnly bool) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	seen := map[string]bool{}
+	for _, name := range strings.Split(viper.GetString("preferredauthentications"), ",") {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
 		}
-		conn, err := (&net.Dialer{LocalAddr: tcpAddr, Timeout: config.Timeout}).Dial("tcp", addr)
+		seen[name] = true
+
+		// Methods we don't support, like gssapi-with-mic, are skipped as OpenSSH
+		// does for those it wasn't built with
+		switch name {
+		case "publickey":
+			methods = append(methods, publicKeyMethod(identityFiles, certificateFiles, identitiesOnly))
+		case "keyboard-interactive":
+			methods = append(methods, authmethod.KeyboardInteractive(authmethod.PromptPassword, authmethod.PromptLine))
+		case "password":
+			methods = append(methods, authmethod.Password(user, host, authmethod.PromptPassword))
+		}
+	}
+	return methods
+}
+
+// defaultIdentityFiles are tried when no identities are configured, as with
+// OpenSSH.
+var defaultIdentityFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ed25519_sk", "~/.ssh/id_ecdsa", "~/.ssh/id_ecdsa_sk", "~/.ssh/id_rsa"}
+
+// publicKeyMethod offers the agent's keys followed by the identity files. Keys
+// with a public half on disk only ask for their passphrase once the server
+// accepts them.
+func publicKeyMethod(identityFiles, certificateFiles []string, identitiesOnly bool) ssh.AuthMethod {
+	for _, fileName := range viper.GetStringSlice("certificatefile") {
+		certificateFiles = append(certificateFiles, expandHome(fileName))
+	}
+
+	// Identities given with -i come first, in the order given
+	var files []string
+	explicit := map[string]bool{}
+	for _, fileName := range viper.GetStringSlice("identity") {
+		fileName = expandHome(fileName)
+		files = append(files, fileName)
+		explicit[fileName] = true
+	}
+	identityFiles = append(files, identityFiles...)
+
+	if len(identityFiles) == 0 {
+		for _, fileName := range defaultIdentityFiles {
+			identityFiles = append(identityFiles, expandHome(fileName))
+		}
+	}
+
+	// Certificates for identities may belong to keys held by the agent, as
+	// security keys always are
+	agentCertificates := append([]string{}, certificateFiles...)
+	for _, fileName := range identityFiles {
+		agentCertificates = append(agentCertificates, fileName+"-cert.pub")
+	}
+
+	agentSigners := authmethod.SSHAgentSigners(agentCertificates...)
+	if identitiesOnly {
+		agentSigners = identityAgentSigners(agentSigners, identityFiles)
+	}
+
+	var signers []ssh.Signer
+	seen := map[string]bool{}
+	for _, fileName := range identityFiles {
+		if seen[fileName] {
+			continue
+		}
+		seen[fileName] = true
+
+		keys, err := authmethod.PrivateKeySigners(fileName, authmethod.PromptPassword, certificateFiles...)
 		if err != nil {
-			return nil, err
+			// Like OpenSSH, identities that weren't asked for explicitly are
+			// optional
+			if errors.Is(err, authmethod.ErrSecurityKey) && authmethod.SystemAgent() != nil {
+				continue
+			}
+			if explicit[fileName] || !errors.Is(err, authmethod.ErrKeyNotFound) {
+				fmt.Fprintf(os.Stderr, "Warning: skipping identity %v\n", err)
+			}
+			continue
+		}
+		signers = append(signers, keys...)
+	}
+
+	return authmethod.PublicKeys(agentSigners, signers...)
+}
+
+// identityAgentSigners narrows the agent's keys to those of identityFiles,
+// which is how OpenSSH treats the agent when IdentitiesOnly is set.
+func identityAgentSigners(agentSigners func() ([]ssh.Signer, error), identityFiles []string) func() ([]ssh.Signer, error) {
+	identities := map[string]bool{}
+	for _, fileName := range identityFiles {
+		if key := authmethod.PublicKeyFile(fileName); key != nil {
+			identities[string(key.Marshal())] = true
 		}
-		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	}
+
+	return func() ([]ssh.Signer, error) {
+		keys, err := agentSigners()
 		if err != nil {
 			return nil, err
 		}
-		return ssh.NewClient(c, chans, reqs), nil
+
+		var signers []ssh.Signer
+		for _, signer := range keys {
+			key := signer.PublicKey()
+			if cert, isCert := key.(*ssh.Certificate); isCert {
+				key = cert.Key
+			}
+			if identities[string(key.Marshal())] {
+				signers = append(signers, signer)
+			}
+		}
+		return signers, nil
 	}
-	return ssh.Dial(network, addr, config)
 }
 
-func forward(client *ssh.Client, localConn net.Conn, socketName string) {
-	remoteConn, err := client.Dial("unix", socketName)
+func dial(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	hops, err := parseJumpHosts(viper.GetString("proxyjump"))
 	if err != nil {
-		fmt.Printf("Remote dial error: %s\n", err)
-		return
+		return nil, err
 	}
 
-	copyConn := func(writer, reader net.Conn) {
-		_, err := io.Copy(writer, reader)
+	if len(hops) > 0 && viper.GetString("proxycommand") != "" {
+		return nil, errors.New("ProxyJump and ProxyCommand are mutually exclusive")
+	}
+
+	if len(hops) == 0 {
+		return dialDirect(network, addr, config)
+	}
+
+	client, err := dialDirect(network, hops[0].Addr(), hops[0].clientConfig(config))
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %v", hops[0].Addr(), err)
+	}
+
+	for _, hop := range hops[1:] {
+		next, err := dialVia(client, hop.Addr(), hop.clientConfig(config))
 		if err != nil {
-			fmt.Printf("io.Copy error: %s", err)
+			client.Close()
+			return nil, fmt.Errorf("jump host %s: %v", hop.Addr(), err)
 		}
+		client = next
 	}
 
-	go copyConn(localConn, remoteConn)
-	go copyConn(remoteConn, localConn)
+	connection, err := dialVia(client, addr, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return connection, nil
 }
 
-func upgrade(mgr *sessions.Manager) {
-	cmd := fmt.Sprintf(`set -euxo pipefail || exit 1; mkdir -p ~/.local/share/code-server; cd %[1]s; /usr/bin/wget -N https://codesrv-ci.cdr.sh/latest-linux; [ -f %[2]s ] && rm %[2]s; ln latest-linux %[2]s; chmod +x %[2]s; exit 0`, path.Dir(codeServerPath), codeServerPath)
+func dialDirect(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if command := viper.GetString("proxycommand"); command != "" && command != "none" {
+		conn, err := dialProxyCommand(expandProxyCommand(command, addr, config.User), addr)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(conn, addr, config)
+	}
+	if bindAddr := viper.GetString("bind"); bindAddr != "" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", bindAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := (&net.Dialer{LocalAddr: tcpAddr, Timeout: config.Timeout}).Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(conn, addr, config)
+	}
+	return ssh.Dial(network, addr, config)
+}
 
-	session, err := mgr.NewSession("upgrade script")
+// newClient establishes an ssh connection over conn, closing conn when the
+// connection ends.
+func newClient(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		log.Fatalf("Unable to create session: %v", err)
+		conn.Close()
+		return nil, err
 	}
 
-	if err := session.Run(cmd); err != nil {
-		log.Fatal("Failed to execute upgrade script: " + err.Error())
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		conn.Close()
+	}()
+
+	return client, nil
+}
+
+// installCodeServer installs the configured version of code-server on the
+// server if it isn't there already, returning the path to run it from.
+func installCodeServer(connection *ssh.Client) (string, error) {
+	var source install.Source = &install.GitHub{}
+	if mirror := viper.GetString("codeservermirror"); mirror != "" {
+		source = &install.Mirror{URL: mirror}
 	}
+
+	installer := &install.Installer{
+		Remote:   &install.SSH{Client: connection},
+		Source:   source,
+		Version:  viper.GetString("codeserverversion"),
+		Checksum: viper.GetString("codeserversha256"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("installtimeout"))
+	defer cancel()
+	return installer.Install(ctx)
 }
 
 func cleanup(mgr *sessions.Manager, socketName string) {
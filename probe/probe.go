@@ -0,0 +1,103 @@
+// Package probe waits for an HTTP service on the far side of an ssh
+// connection to start answering.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Dialer opens connections to the service, as *ssh.Client does on the
+// server.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Prober polls a service until it answers.
+type Prober struct {
+	Dialer Dialer
+	// Path is requested to check the service's health, a response below 500
+	// means it's ready.
+	Path string
+	// Backoff is how long to wait after the first failed attempt, doubling
+	// each time up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Defaults used when the Prober leaves them unset.
+const (
+	DefaultPath       = "/healthz"
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// Wait polls the service listening on network and addr until it answers or
+// ctx is done, returning the last failure along with ctx's error.
+func (p *Prober) Wait(ctx context.Context, network, addr string) error {
+	path, backoff, maxBackoff := p.Path, p.Backoff, p.MaxBackoff
+	if path == "" {
+		path = DefaultPath
+	}
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return p.Dialer.Dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	for {
+		err := p.check(ctx, client, path)
+		if err == nil {
+			return nil
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last attempt: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// errNotReady is returned for responses from a service that's still coming
+// up.
+var errNotReady = errors.New("service not ready")
+
+func (p *Prober) check(ctx context.Context, client *http.Client, path string) error {
+	// The host only goes in the request, connections go to addr
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: %s", errNotReady, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package probe_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/probe"
+)
+
+// localDialer dials on this machine, standing in for the ssh client.
+type localDialer struct {
+	dials int32
+}
+
+func (d *localDialer) Dial(network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return net.Dial(network, addr)
+}
+
+// serve answers requests on socket with handler once delay has passed.
+func serve(t *testing.T, socket string, delay time.Duration, handler http.Handler) {
+	t.Helper()
+
+	server := &http.Server{Handler: handler}
+	t.Cleanup(func() { server.Close() })
+
+	start := func() {
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server.Serve(listener)
+	}
+
+	if delay == 0 {
+		go start()
+		return
+	}
+	timer := time.AfterFunc(delay, start)
+	t.Cleanup(func() { timer.Stop() })
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+
+	socket := filepath.Join(t.TempDir(), "code-server.sock")
+
+	var requests int32
+	serve(t, socket, 300*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("expected a request for /healthz, got %s", r.URL.Path)
+		}
+		// Still starting up the first time round
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	dialer := &localDialer{}
+	prober := &probe.Prober{Dialer: dialer, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := prober.Wait(ctx, "unix", socket); err != nil {
+		t.Fatalf("expected the service to become ready, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if n := atomic.LoadInt32(&dialer.dials); n < 3 {
+		t.Errorf("expected failed dials before the service was listening, got %d dials", n)
+	}
+}
+
+func TestWaitNotFound(t *testing.T) {
+	t.Parallel()
+
+	// Services without a health check still count once they answer
+	socket := filepath.Join(t.TempDir(), "code-server.sock")
+	serve(t, socket, 0, http.NotFoundHandler())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := (&probe.Prober{Dialer: &localDialer{}}).Wait(ctx, "unix", socket); err != nil {
+		t.Fatalf("expected the service to be ready, got %v", err)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	t.Parallel()
+
+	socket := filepath.Join(t.TempDir(), "code-server.sock")
+	serve(t, socket, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := (&probe.Prober{Dialer: &localDialer{}, Backoff: 10 * time.Millisecond}).Wait(ctx, "unix", socket)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	t.Parallel()
+
+	// Nothing ever listens, as when the service exits early
+	socket := filepath.Join(t.TempDir(), "code-server.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err := (&probe.Prober{Dialer: &localDialer{}}).Wait(ctx, "unix", socket)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
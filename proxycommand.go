@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyCommandConn is a net.Conn talking to the stdin and stdout of a
+// ProxyCommand helper.
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   proxyCommandAddr
+	once   sync.Once
+	err    error
+}
+
+// proxyCommandAddr is the host:port the helper was asked to reach, which
+// stands in for the remote address when checking host keys.
+type proxyCommandAddr string
+
+func (a proxyCommandAddr) Network() string {
+	return "proxycommand"
+}
+
+func (a proxyCommandAddr) String() string {
+	return string(a)
+}
+
+// expandProxyCommand replaces the OpenSSH tokens supported in ProxyCommand.
+func expandProxyCommand(command, addr, user string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%p", port,
+		"%r", user,
+	).Replace(command)
+}
+
+// dialProxyCommand starts command to reach addr and returns a connection
+// using its stdin and stdout. The helper's stderr is passed through to ours.
+func dialProxyCommand(command, addr string) (net.Conn, error) {
+	cmd := shellCommand(command)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &proxyCommandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		addr:   proxyCommandAddr(addr),
+	}, nil
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close closes the helper's stdin and reaps it, killing it if it doesn't exit
+// promptly by itself.
+func (c *proxyCommandConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+
+		done := make(chan error, 1)
+		go func() { done <- c.cmd.Wait() }()
+
+		select {
+		case err := <-done:
+			c.err = err
+		case <-time.After(time.Second):
+			c.cmd.Process.Kill()
+			<-done
+		}
+	})
+	return c.err
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *proxyCommandConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+var errProxyCommandDeadline = errors.New("deadlines are not supported by ProxyCommand connections")
+
+func (c *proxyCommandConn) SetDeadline(t time.Time) error {
+	return errProxyCommandDeadline
+}
+
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error {
+	return errProxyCommandDeadline
+}
+
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error {
+	return errProxyCommandDeadline
+}
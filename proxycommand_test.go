@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestExpandProxyCommand(t *testing.T) {
+	tests := []struct {
+		command, addr, user string
+		want                string
+	}{
+		{"nc %h %p", "gw.example:2222", "alice", "nc gw.example 2222"},
+		{"ssh -W %h:%p %r@bastion", "gw.example:22", "alice", "ssh -W gw.example:22 alice@bastion"},
+		{"nc %h %p", "[::1]:22", "", "nc ::1 22"},
+		{"nc %h", "gw.example", "", "nc gw.example"},
+		{"printf 100%%p %%h%h", "gw.example:22", "", "printf 100%p %hgw.example"},
+		{"connect %x", "gw.example:22", "", "connect %x"},
+	}
+
+	for _, test := range tests {
+		if got := expandProxyCommand(test.command, test.addr, test.user); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.command, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func shellCommand(command string) *exec.Cmd {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return exec.Command(shell, "-c", "exec "+command)
+}
@@ -0,0 +1,97 @@
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestProxyCommandConn(t *testing.T) {
+	conn, err := dialProxyCommand("cat", "server.example:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected ping, got %q", buf)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Errorf("expected a clean exit, got %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("expected closing again to be harmless, got %v", err)
+	}
+}
+
+func TestProxyCommandConnClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		exit    bool
+		max     time.Duration
+	}{
+		// Exits as soon as stdin is closed, with its status reported
+		{"exits", "sh -c 'cat >/dev/null; exit 3'", true, 500 * time.Millisecond},
+		// Ignores stdin, so is killed after the grace period
+		{"killed", "sleep 30", false, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := dialProxyCommand(test.command, "server.example:22")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc := conn.(*proxyCommandConn)
+
+			start := time.Now()
+			err = conn.Close()
+			if elapsed := time.Since(start); elapsed > test.max {
+				t.Errorf("expected close within %s, took %s", test.max, elapsed)
+			}
+
+			if test.exit {
+				if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+					t.Errorf("expected exit status 3, got %v", err)
+				}
+			} else if pc.cmd.ProcessState == nil || pc.cmd.ProcessState.Exited() {
+				t.Errorf("expected the helper to be killed, got %v", pc.cmd.ProcessState)
+			}
+		})
+	}
+}
+
+func TestProxyCommandConnHostKey(t *testing.T) {
+	useKnownHosts(t, "accept-new", false)
+	key := newSigner(t).PublicKey()
+
+	// Helpers are usually given the host and port as separate arguments, which
+	// the command line makes no address of
+	conn, err := dialProxyCommand(expandProxyCommand("cat # %h %p", "server.example:22", "alice"), "server.example:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := KnownHostsHandler()("server.example:22", conn.RemoteAddr(), key); err != nil {
+		t.Errorf("expected the new host key to be accepted, got %v", err)
+	}
+
+	viper.Set("stricthostkeychecking", "yes")
+	if err := KnownHostsHandler()("server.example:22", conn.RemoteAddr(), key); err != nil {
+		t.Errorf("expected the recorded host key to be trusted, got %v", err)
+	}
+}
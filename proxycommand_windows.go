@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os/exec"
+)
+
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/c", command)
+}
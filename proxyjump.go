@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseJumpHosts parses a ProxyJump specification, a comma separated list of
+// [user@]host[:port] hops, resolving each hop through the ssh config.
+func parseJumpHosts(spec string) ([]*hostConfig, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+
+	var hops []*hostConfig
+	for _, hop := range strings.Split(spec, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		if hop == "" {
+			return nil, fmt.Errorf("empty jump host in %q", spec)
+		}
+
+		var user string
+		if i := strings.LastIndex(hop, "@"); i >= 0 {
+			user, hop = hop[:i], hop[i+1:]
+		}
+
+		host, port, err := net.SplitHostPort(hop)
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "missing port in address") {
+				return nil, fmt.Errorf("invalid jump host %q: %v", hop, err)
+			}
+			host = hop
+		}
+
+		var portNum int
+		if port != "" {
+			if portNum, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("invalid port for jump host %q: %v", hop, err)
+			}
+		}
+
+		cfg := lookupHost(host, user, portNum)
+		if cfg.Port == 0 {
+			cfg.Port = 22
+		}
+
+		hops = append(hops, cfg)
+	}
+
+	return hops, nil
+}
+
+func (c *hostConfig) Addr() string {
+	return net.JoinHostPort(c.HostName, strconv.Itoa(c.Port))
+}
+
+// clientConfig derives the configuration for connecting to a jump host from
+// the one used for the target host. Like OpenSSH, a hop without a user of its
+// own logs in as the local user rather than the target's login.
+func (c *hostConfig) clientConfig(base *ssh.ClientConfig) *ssh.ClientConfig {
+	config := *base
+	config.User = c.User
+	if config.User == "" {
+		config.User = localUser()
+	}
+	config.Auth = authMethods(config.User, c.HostName, c.IdentityFiles, c.CertificateFiles, c.IdentitiesOnly)
+	return &config
+}
+
+// localUser is the name of the user running sshcode, without any Windows
+// domain.
+func localUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	name := current.Username
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// dialVia establishes an ssh connection to addr tunnelled through an existing
+// connection. The tunnelling connection is closed along with the new one.
+func dialVia(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(conn, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		client.Wait()
+		via.Close()
+	}()
+
+	return client, nil
+}
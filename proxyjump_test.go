@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	useSSHConfig(t, `
+Host bastion
+    HostName bastion.example
+    User jump
+    Port 2201
+`, nil)
+
+	tests := []struct {
+		spec  string
+		addrs []string
+		users []string
+		err   bool
+	}{
+		{spec: "", addrs: nil},
+		{spec: "none", addrs: nil},
+		{spec: "gw.example", addrs: []string{"gw.example:22"}, users: []string{""}},
+		{spec: "alice@gw.example:2222", addrs: []string{"gw.example:2222"}, users: []string{"alice"}},
+		{spec: "ssh://alice@gw.example:2222", addrs: []string{"gw.example:2222"}, users: []string{"alice"}},
+		{spec: "[::1]:22", addrs: []string{"[::1]:22"}, users: []string{""}},
+		{spec: "bob@[::1]:2022", addrs: []string{"[::1]:2022"}, users: []string{"bob"}},
+		{spec: "bastion", addrs: []string{"bastion.example:2201"}, users: []string{"jump"}},
+		{spec: "alice@bastion:22", addrs: []string{"bastion.example:22"}, users: []string{"alice"}},
+		{
+			spec:  "alice@gw.example, bastion,[::1]:2022",
+			addrs: []string{"gw.example:22", "bastion.example:2201", "[::1]:2022"},
+			users: []string{"alice", "jump", ""},
+		},
+		{spec: "gw.example,", err: true},
+		{spec: "gw.example:ssh", err: true},
+		{spec: "[::1", err: true},
+	}
+
+	for _, test := range tests {
+		hops, err := parseJumpHosts(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+
+		var addrs, users []string
+		for _, hop := range hops {
+			addrs = append(addrs, hop.Addr())
+			users = append(users, hop.User)
+		}
+		if !reflect.DeepEqual(addrs, test.addrs) {
+			t.Errorf("%q: expected hops %v, got %v", test.spec, test.addrs, addrs)
+		}
+		if !reflect.DeepEqual(users, test.users) {
+			t.Errorf("%q: expected users %v, got %v", test.spec, test.users, users)
+		}
+	}
+}
+
+func TestJumpHostClientConfig(t *testing.T) {
+	useSSHConfig(t, `
+Host bastion
+    User jump
+`, nil)
+
+	base := &ssh.ClientConfig{User: "login"}
+
+	tests := []struct {
+		spec string
+		user string
+	}{
+		{"gw.example", localUser()},
+		{"alice@gw.example", "alice"},
+		{"bastion", "jump"},
+		{"alice@bastion", "alice"},
+	}
+
+	for _, test := range tests {
+		hops, err := parseJumpHosts(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := hops[0].clientConfig(base)
+		if config.User != test.user {
+			t.Errorf("%q: expected user %s, got %s", test.spec, test.user, config.User)
+		}
+		if config == base {
+			t.Errorf("%q: expected a copy of the base config", test.spec)
+		}
+	}
+
+	if base.User != "login" {
+		t.Errorf("expected the base config to be left alone, got user %s", base.User)
+	}
+}
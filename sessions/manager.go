@@ -4,14 +4,16 @@ import (
 	"fmt"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type Manager struct {
-	client     *ssh.Client
-	sessions   map[*Session]struct{}
-	broadcast  chan Message
-	register   chan *Session
-	unregister chan *Session
+	client       *ssh.Client
+	forwardAgent bool
+	sessions     map[*Session]struct{}
+	broadcast    chan Message
+	register     chan *Session
+	unregister   chan *Session
 }
 
 func NewManager(c *ssh.Client) *Manager {
@@ -32,11 +34,29 @@ func (m *Manager) Broadcast(msg Message) {
 	}
 }
 
+// ForwardAgent serves keys to the server so that sessions created afterwards
+// can use them, like ssh -A.
+func (m *Manager) ForwardAgent(keys agent.Agent) error {
+	if err := agent.ForwardToAgent(m.client, keys); err != nil {
+		return err
+	}
+	m.forwardAgent = true
+	return nil
+}
+
 func (m *Manager) NewSession(name string) (*Session, error) {
 	sess, err := m.client.NewSession()
 	if err != nil {
 		return nil, err
 	}
+
+	// Like OpenSSH, carry on without the agent if the server refuses it
+	if m.forwardAgent {
+		if err := agent.RequestAgentForwarding(sess); err != nil {
+			fmt.Println("[sessions] Agent forwarding request failed for " + name + ": " + err.Error())
+		}
+	}
+
 	return &Session{
 		name:     name,
 		manager:  m,
@@ -0,0 +1,165 @@
+package sessions_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/sessions"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentServer is an in-process ssh server that answers
+// auth-agent-req@openssh.com on session channels with allow, listing the keys
+// of any agent it is given access to.
+type agentServer struct {
+	allow     bool
+	requested chan struct{}
+	keys      chan []*agent.Key
+}
+
+func newAgentServer(t *testing.T, allow bool) (*agentServer, *ssh.Client) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &agentServer{
+		allow:     allow,
+		requested: make(chan struct{}, 1),
+		keys:      make(chan []*agent.Key, 1),
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.serve(conn, config)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return server, client
+}
+
+func (s *agentServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "auth-agent-req@openssh.com" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(s.allow, nil)
+				s.requested <- struct{}{}
+				if s.allow {
+					go s.listKeys(serverConn)
+				}
+			}
+		}()
+	}
+}
+
+// listKeys reaches the client's agent the way sshd does for a process using
+// SSH_AUTH_SOCK.
+func (s *agentServer) listKeys(serverConn *ssh.ServerConn) {
+	channel, requests, err := serverConn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		s.keys <- nil
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	keys, _ := agent.NewClient(channel).List()
+	s.keys <- keys
+}
+
+func TestForwardAgent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "forwarded"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, allow := range []bool{true, false} {
+		server, client := newAgentServer(t, allow)
+
+		mgr := sessions.NewManager(client)
+		go mgr.Run()
+
+		if err := mgr.ForwardAgent(keyring); err != nil {
+			t.Fatal(err)
+		}
+
+		// A server refusing the agent still gets a session
+		if _, err := mgr.NewSession("test"); err != nil {
+			t.Fatalf("allow %v: %v", allow, err)
+		}
+
+		select {
+		case <-server.requested:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("allow %v: expected agent forwarding to be requested for the session", allow)
+		}
+
+		if !allow {
+			continue
+		}
+
+		select {
+		case keys := <-server.keys:
+			if len(keys) != 1 || keys[0].Comment != "forwarded" {
+				t.Errorf("expected the server to reach the forwarded agent, got keys %v", keys)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the server to reach the forwarded agent")
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/spf13/viper"
+)
+
+// sshConfigSource looks up settings for host aliases, normally from the
+// OpenSSH client configuration.
+type sshConfigSource interface {
+	Get(alias, key string) string
+	GetAll(alias, key string) []string
+}
+
+var sshConfigSettings sshConfigSource = loadSSHConfig(userSSHConfig(), "/etc/ssh/ssh_config")
+
+// sshConfigFiles looks settings up in each OpenSSH client config in turn, so
+// that the first value found wins as in OpenSSH.
+type sshConfigFiles []*ssh_config.Config
+
+func (files sshConfigFiles) Get(alias, key string) string {
+	for _, cfg := range files {
+		if val, err := cfg.Get(alias, key); err == nil && val != "" {
+			return val
+		}
+	}
+	return ssh_config.Default(key)
+}
+
+func (files sshConfigFiles) GetAll(alias, key string) []string {
+	var all []string
+	for _, cfg := range files {
+		if vals, err := cfg.GetAll(alias, key); err == nil {
+			all = append(all, vals...)
+		}
+	}
+	return all
+}
+
+func userSSHConfig() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// loadSSHConfig loads OpenSSH client configs such as ~/.ssh/config and
+// /etc/ssh/ssh_config, including any Include directives. Each file is loaded
+// on its own so one that can't be parsed doesn't take the others with it.
+// Relative Includes are found in ~/.ssh, even from the system config.
+func loadSSHConfig(files ...string) sshConfigFiles {
+	var configs sshConfigFiles
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring ssh config %s: %v\n", file, err)
+			continue
+		}
+
+		cfg, err := ssh_config.Decode(f)
+		f.Close()
+		if err != nil {
+			if strings.Contains(err.Error(), "Match") {
+				fmt.Fprintf(os.Stderr, "Ignoring ssh config %s as Match blocks aren't supported (%v)\n", file, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Ignoring ssh config %s: %v\n", file, err)
+			}
+			continue
+		}
+
+		configs = append(configs, cfg)
+	}
+	return configs
+}
+
+// hostConfig holds the settings for a single host alias as found in the
+// OpenSSH client configuration. Values that are only OpenSSH defaults are
+// left empty so they don't override sshcode's own defaults.
+type hostConfig struct {
+	Alias            string
+	HostName         string
+	User             string
+	Port             int
+	IdentityFiles    []string
+	CertificateFiles []string
+	IdentitiesOnly   bool
+	ForwardAgent     bool
+	IdentityAgent    string
+	AddKeysToAgent   string
+	ProxyJump        string
+	ProxyCommand     string
+
+	PreferredAuthentications string
+	NumberOfPasswordPrompts  int
+
+	Ciphers           string
+	KexAlgorithms     string
+	MACs              string
+	HostKeyAlgorithms string
+
+	StrictHostKeyChecking string
+	VerifyHostKeyDNS      string
+	HashKnownHosts        bool
+	UserKnownHostsFile    []string
+	GlobalKnownHostsFile  []string
+}
+
+// lookupHost returns the settings for alias. The user and port that will
+// actually be used, when given, take the place of those in the config and are
+// what %r and %p expand to.
+func lookupHost(alias, user string, port int) *hostConfig {
+	get := func(key string) string {
+		val := sshConfigSettings.Get(alias, key)
+		if val == ssh_config.Default(key) {
+			return ""
+		}
+		return val
+	}
+
+	cfg := &hostConfig{
+		Alias:          alias,
+		HostName:       alias,
+		User:           get("User"),
+		IdentitiesOnly: get("IdentitiesOnly") == "yes",
+		ForwardAgent:   get("ForwardAgent") == "yes",
+		IdentityAgent:  get("IdentityAgent"),
+		AddKeysToAgent: get("AddKeysToAgent"),
+
+		PreferredAuthentications: get("PreferredAuthentications"),
+
+		Ciphers:           get("Ciphers"),
+		KexAlgorithms:     get("KexAlgorithms"),
+		MACs:              get("MACs"),
+		HostKeyAlgorithms: get("HostKeyAlgorithms"),
+
+		StrictHostKeyChecking: get("StrictHostKeyChecking"),
+		VerifyHostKeyDNS:      get("VerifyHostKeyDNS"),
+		HashKnownHosts:        get("HashKnownHosts") == "yes",
+		UserKnownHostsFile:    strings.Fields(get("UserKnownHostsFile")),
+		GlobalKnownHostsFile:  strings.Fields(get("GlobalKnownHostsFile")),
+	}
+
+	if user != "" {
+		cfg.User = user
+	}
+
+	if port != 0 {
+		cfg.Port = port
+	} else if configPort := get("Port"); configPort != "" {
+		p, err := strconv.Atoi(configPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring invalid port %q in ssh config for %s\n", configPort, alias)
+		}
+		cfg.Port = p
+	}
+
+	if hostName := get("HostName"); hostName != "" {
+		cfg.HostName = cfg.expand(hostName)
+	}
+
+	if prompts := get("NumberOfPasswordPrompts"); prompts != "" {
+		p, err := strconv.Atoi(prompts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring invalid NumberOfPasswordPrompts %q in ssh config for %s\n", prompts, alias)
+		}
+		cfg.NumberOfPasswordPrompts = p
+	}
+
+	for _, file := range sshConfigSettings.GetAll(alias, "IdentityFile") {
+		if file != ssh_config.Default("IdentityFile") {
+			cfg.IdentityFiles = append(cfg.IdentityFiles, expandHome(cfg.expand(file)))
+		}
+	}
+
+	for _, file := range sshConfigSettings.GetAll(alias, "CertificateFile") {
+		if file != "" {
+			cfg.CertificateFiles = append(cfg.CertificateFiles, expandHome(cfg.expand(file)))
+		}
+	}
+
+	if proxyJump := get("ProxyJump"); proxyJump != "none" {
+		cfg.ProxyJump = proxyJump
+	}
+
+	if proxyCommand := get("ProxyCommand"); proxyCommand != "none" {
+		cfg.ProxyCommand = proxyCommand
+	}
+
+	return cfg
+}
+
+// expand replaces the subset of OpenSSH tokens that make sense before a
+// connection is established.
+func (c *hostConfig) expand(val string) string {
+	port := c.Port
+	if port == 0 {
+		port = 22
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", os.Getenv("HOME"),
+		"%h", c.HostName,
+		"%n", c.Alias,
+		"%p", strconv.Itoa(port),
+		"%r", c.User,
+		"%u", os.Getenv("USER"),
+	).Replace(val)
+}
+
+func expandHome(file string) string {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return file
+		}
+		return filepath.Join(home, file[1:])
+	}
+	return file
+}
+
+// applySSHConfig resolves alias through the OpenSSH client configuration,
+// setting login, port and identity options in viper unless they were given
+// explicitly, and returns the host name to connect to.
+func applySSHConfig(alias string, loginSet, portSet bool) string {
+	var login string
+	if loginSet {
+		login = viper.GetString("login")
+	}
+	var port int
+	if portSet {
+		port = viper.GetInt("port")
+	}
+
+	cfg := lookupHost(alias, login, port)
+
+	if cfg.User != "" && !loginSet {
+		viper.Set("login", cfg.User)
+	}
+
+	if cfg.Port != 0 && !portSet {
+		viper.Set("port", cfg.Port)
+	}
+
+	if len(cfg.IdentityFiles) > 0 {
+		viper.Set("identityfiles", cfg.IdentityFiles)
+	}
+
+	if len(cfg.CertificateFiles) > 0 {
+		viper.Set("certificatefiles", cfg.CertificateFiles)
+	}
+
+	if cfg.IdentitiesOnly {
+		viper.Set("identitiesonly", true)
+	}
+
+	if cfg.ForwardAgent {
+		viper.SetDefault("forwardagent", true)
+	}
+
+	for key, val := range map[string]string{
+		"identityagent":  cfg.IdentityAgent,
+		"addkeystoagent": cfg.AddKeysToAgent,
+	} {
+		if val != "" && viper.GetString(key) == "" {
+			viper.Set(key, val)
+		}
+	}
+
+	if cfg.PreferredAuthentications != "" {
+		viper.SetDefault("preferredauthentications", cfg.PreferredAuthentications)
+	}
+
+	if cfg.NumberOfPasswordPrompts > 0 {
+		viper.SetDefault("numberofpasswordprompts", cfg.NumberOfPasswordPrompts)
+	}
+
+	for key, val := range map[string]string{
+		"ciphers":           cfg.Ciphers,
+		"kexalgorithms":     cfg.KexAlgorithms,
+		"macs":              cfg.MACs,
+		"hostkeyalgorithms": cfg.HostKeyAlgorithms,
+	} {
+		if val != "" && viper.GetString(key) == "" {
+			viper.Set(key, val)
+		}
+	}
+
+	if cfg.StrictHostKeyChecking != "" && viper.GetString("stricthostkeychecking") == "" {
+		viper.Set("stricthostkeychecking", cfg.StrictHostKeyChecking)
+	}
+
+	if cfg.VerifyHostKeyDNS != "" && viper.GetString("verifyhostkeydns") == "" {
+		viper.Set("verifyhostkeydns", cfg.VerifyHostKeyDNS)
+	}
+
+	if cfg.HashKnownHosts {
+		viper.SetDefault("hashknownhosts", true)
+	}
+
+	if len(cfg.UserKnownHostsFile) > 0 {
+		viper.SetDefault("userknownhostsfile", cfg.UserKnownHostsFile)
+	}
+
+	if len(cfg.GlobalKnownHostsFile) > 0 {
+		viper.SetDefault("globalknownhostsfile", cfg.GlobalKnownHostsFile)
+	}
+
+	// A proxy given explicitly replaces any from ssh config
+	if viper.GetString("proxyjump") == "" && viper.GetString("proxycommand") == "" {
+		if cfg.ProxyJump != "" {
+			viper.Set("proxyjump", cfg.ProxyJump)
+		} else if cfg.ProxyCommand != "" {
+			viper.Set("proxycommand", cfg.ProxyCommand)
+		}
+	}
+
+	return cfg.HostName
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/spf13/viper"
+)
+
+// useSSHConfig points lookups at contents for the rest of the test, where
+// {dir} stands for a temporary directory that also serves as home. Viper
+// starts out empty.
+func useSSHConfig(t *testing.T, contents string, extra map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+
+	for name, data := range extra {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(strings.ReplaceAll(data, "{dir}", dir)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := ssh_config.Decode(strings.NewReader(strings.ReplaceAll(contents, "{dir}", dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := sshConfigSettings
+	sshConfigSettings = sshConfigFiles{cfg}
+	viper.Reset()
+	t.Cleanup(func() {
+		sshConfigSettings = previous
+		viper.Reset()
+	})
+
+	return dir
+}
+
+const testSSHConfig = `
+Include {dir}/extra.conf
+
+Host web
+    HostName %h.internal.example
+    User deploy
+    Port 2222
+    IdentityFile ~/.ssh/id_%r_%p
+    CertificateFile ~/.ssh/%n-cert.pub
+    Ciphers aes128-ctr
+    ForwardAgent yes
+
+Host ported
+    HostName host-%p
+    Port 2022
+
+Host unported
+    HostName host-%p
+`
+
+func TestLookupHost(t *testing.T) {
+	dir := useSSHConfig(t, testSSHConfig, map[string]string{
+		"extra.conf": "Host included\n    HostName included.example\n    User inc\n",
+	})
+
+	tests := []struct {
+		name                 string
+		alias, user          string
+		port                 int
+		wantHostName         string
+		wantUser             string
+		wantPort             int
+		wantIdentityFiles    []string
+		wantCertificateFiles []string
+	}{
+		{
+			name:  "alias",
+			alias: "web", wantHostName: "web.internal.example", wantUser: "deploy", wantPort: 2222,
+			wantIdentityFiles:    []string{filepath.Join(dir, ".ssh", "id_deploy_2222")},
+			wantCertificateFiles: []string{filepath.Join(dir, ".ssh", "web-cert.pub")},
+		},
+		{
+			name:  "login given",
+			alias: "web", user: "alice", wantHostName: "web.internal.example", wantUser: "alice", wantPort: 2222,
+			wantIdentityFiles:    []string{filepath.Join(dir, ".ssh", "id_alice_2222")},
+			wantCertificateFiles: []string{filepath.Join(dir, ".ssh", "web-cert.pub")},
+		},
+		{
+			name:  "port given",
+			alias: "web", port: 2200, wantHostName: "web.internal.example", wantUser: "deploy", wantPort: 2200,
+			wantIdentityFiles:    []string{filepath.Join(dir, ".ssh", "id_deploy_2200")},
+			wantCertificateFiles: []string{filepath.Join(dir, ".ssh", "web-cert.pub")},
+		},
+		{
+			name:  "port in host name",
+			alias: "ported", wantHostName: "host-2022", wantPort: 2022,
+		},
+		{
+			name:  "default port in host name",
+			alias: "unported", wantHostName: "host-22",
+		},
+		{
+			name:  "included",
+			alias: "included", wantHostName: "included.example", wantUser: "inc",
+		},
+		{
+			name:  "unknown",
+			alias: "elsewhere.example", wantHostName: "elsewhere.example",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := lookupHost(test.alias, test.user, test.port)
+			if cfg.HostName != test.wantHostName {
+				t.Errorf("expected host name %s, got %s", test.wantHostName, cfg.HostName)
+			}
+			if cfg.User != test.wantUser {
+				t.Errorf("expected user %q, got %q", test.wantUser, cfg.User)
+			}
+			if cfg.Port != test.wantPort {
+				t.Errorf("expected port %d, got %d", test.wantPort, cfg.Port)
+			}
+			if !reflect.DeepEqual(cfg.IdentityFiles, test.wantIdentityFiles) {
+				t.Errorf("expected identity files %v, got %v", test.wantIdentityFiles, cfg.IdentityFiles)
+			}
+			if !reflect.DeepEqual(cfg.CertificateFiles, test.wantCertificateFiles) {
+				t.Errorf("expected certificate files %v, got %v", test.wantCertificateFiles, cfg.CertificateFiles)
+			}
+		})
+	}
+}
+
+func TestApplySSHConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		set        map[string]interface{}
+		loginSet   bool
+		portSet    bool
+		wantLogin  string
+		wantPort   int
+		wantCipher string
+		wantAgent  bool
+	}{
+		{
+			name:       "from ssh config",
+			wantLogin:  "deploy",
+			wantPort:   2222,
+			wantCipher: "aes128-ctr",
+			wantAgent:  true,
+		},
+		{
+			name:       "flags win",
+			set:        map[string]interface{}{"login": "alice", "port": 2200, "ciphers": "chacha20-poly1305@openssh.com", "forwardagent": false},
+			loginSet:   true,
+			portSet:    true,
+			wantLogin:  "alice",
+			wantPort:   2200,
+			wantCipher: "chacha20-poly1305@openssh.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useSSHConfig(t, testSSHConfig, nil)
+			for key, val := range test.set {
+				viper.Set(key, val)
+			}
+
+			if host := applySSHConfig("web", test.loginSet, test.portSet); host != "web.internal.example" {
+				t.Errorf("expected host web.internal.example, got %s", host)
+			}
+			if login := viper.GetString("login"); login != test.wantLogin {
+				t.Errorf("expected login %s, got %s", test.wantLogin, login)
+			}
+			if port := viper.GetInt("port"); port != test.wantPort {
+				t.Errorf("expected port %d, got %d", test.wantPort, port)
+			}
+			if cipher := viper.GetString("ciphers"); cipher != test.wantCipher {
+				t.Errorf("expected ciphers %s, got %s", test.wantCipher, cipher)
+			}
+			if agent := viper.GetBool("forwardagent"); agent != test.wantAgent {
+				t.Errorf("expected forwardagent %v, got %v", test.wantAgent, agent)
+			}
+
+			// Identity files are expanded with the login and port in use
+			want := filepath.Join(os.Getenv("HOME"), ".ssh", "id_"+test.wantLogin+"_"+viper.GetString("port"))
+			if files := viper.GetStringSlice("identityfiles"); len(files) != 1 || files[0] != want {
+				t.Errorf("expected identity files [%s], got %v", want, files)
+			}
+		})
+	}
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"user":   "Host web\n    User deploy\n",
+		"system": "Host *\n    User admin\n    Port 2022\n",
+		"match":  "Match host web\n    User deploy\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		files []string
+		user  string
+		port  string
+	}{
+		{"both", []string{"user", "system"}, "deploy", "2022"},
+		{"missing user config", []string{"missing", "system"}, "admin", "2022"},
+		{"unsupported user config", []string{"match", "system"}, "admin", "2022"},
+		{"unsupported system config", []string{"user", "match"}, "deploy", "22"},
+	}
+
+	for _, test := range tests {
+		var paths []string
+		for _, file := range test.files {
+			paths = append(paths, filepath.Join(dir, file))
+		}
+
+		settings := loadSSHConfig(paths...)
+		if user := settings.Get("web", "User"); user != test.user {
+			t.Errorf("%s: expected user %q, got %q", test.name, test.user, user)
+		}
+		if port := settings.Get("web", "Port"); port != test.port {
+			t.Errorf("%s: expected port %q, got %q", test.name, test.port, port)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package sshfp
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNSResolver queries name servers directly for SSHFP records, asking them
+// to validate the answer with DNSSEC.
+type DNSResolver struct {
+	// Servers are the addresses of the name servers to try in turn, on port
+	// 53 unless given as host:port. They default to those in
+	// /etc/resolv.conf, which have to be given on Windows.
+	Servers []string
+}
+
+func (r *DNSResolver) servers() ([]string, error) {
+	if len(r.Servers) == 0 {
+		return SystemServers()
+	}
+
+	servers := make([]string, len(r.Servers))
+	for i, server := range r.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		servers[i] = server
+	}
+	return servers, nil
+}
+
+func (r *DNSResolver) LookupSSHFP(host string) ([]Record, bool, error) {
+	servers, err := r.servers()
+	if err != nil {
+		return nil, false, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), dns.TypeSSHFP)
+	msg.SetEdns0(4096, true)
+	msg.AuthenticatedData = true
+
+	lastErr := errors.New("no name servers")
+	for _, server := range servers {
+		resp, err := exchange(msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, resp.AuthenticatedData, nil
+		default:
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var records []Record
+		for _, rr := range resp.Answer {
+			sshfp, isa := rr.(*dns.SSHFP)
+			if !isa {
+				continue
+			}
+
+			fingerprint, err := hex.DecodeString(sshfp.FingerPrint)
+			if err != nil {
+				continue
+			}
+
+			records = append(records, Record{
+				Algorithm:   sshfp.Algorithm,
+				Type:        sshfp.Type,
+				Fingerprint: fingerprint,
+			})
+		}
+
+		return records, resp.AuthenticatedData, nil
+	}
+
+	return nil, false, lastErr
+}
+
+// exchange sends msg over UDP, retrying over TCP if the answer didn't fit.
+func exchange(msg *dns.Msg, server string) (*dns.Msg, error) {
+	resp, _, err := new(dns.Client).Exchange(msg, server)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp"}).Exchange(msg, server)
+	}
+	return resp, err
+}
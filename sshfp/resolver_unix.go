@@ -0,0 +1,23 @@
+// +build !windows
+
+package sshfp
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SystemServers returns the name servers in /etc/resolv.conf.
+func SystemServers() ([]string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]string, len(conf.Servers))
+	for i, server := range conf.Servers {
+		servers[i] = net.JoinHostPort(server, conf.Port)
+	}
+	return servers, nil
+}
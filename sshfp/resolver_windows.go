@@ -0,0 +1,9 @@
+package sshfp
+
+import "errors"
+
+// SystemServers can't find the name servers on Windows, so they have to be
+// given.
+func SystemServers() ([]string, error) {
+	return nil, errors.New("finding the system name servers isn't supported on Windows")
+}
@@ -0,0 +1,134 @@
+// Package sshfp verifies ssh host keys against SSHFP records published in
+// DNS, as described in RFC 4255 and RFC 6594.
+package sshfp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHFP algorithm numbers
+const (
+	AlgorithmRSA     = 1
+	AlgorithmDSA     = 2
+	AlgorithmECDSA   = 3
+	AlgorithmEd25519 = 4
+)
+
+// TypeSHA256 is the SSHFP fingerprint type for SHA-256.
+const TypeSHA256 = 2
+
+// Record is a single SSHFP resource record.
+type Record struct {
+	Algorithm   uint8
+	Type        uint8
+	Fingerprint []byte
+}
+
+// Resolver looks up the SSHFP records for a host.
+type Resolver interface {
+	// LookupSSHFP returns the records published for host and whether the
+	// answer was authenticated with DNSSEC.
+	LookupSSHFP(host string) (records []Record, secure bool, err error)
+}
+
+// Algorithm returns the SSHFP algorithm number for key, or 0 if it has none.
+func Algorithm(key ssh.PublicKey) uint8 {
+	switch key.Type() {
+	case ssh.KeyAlgoRSA:
+		return AlgorithmRSA
+	case ssh.KeyAlgoDSA:
+		return AlgorithmDSA
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return AlgorithmECDSA
+	case ssh.KeyAlgoED25519:
+		return AlgorithmEd25519
+	}
+	return 0
+}
+
+// Fingerprint returns the SHA-256 SSHFP fingerprint of key.
+func Fingerprint(key ssh.PublicKey) []byte {
+	sum := sha256.Sum256(key.Marshal())
+	return sum[:]
+}
+
+// Match reports whether any of records holds the SHA-256 fingerprint of key.
+func Match(records []Record, key ssh.PublicKey) bool {
+	algorithm := Algorithm(key)
+	if algorithm == 0 {
+		return false
+	}
+
+	fingerprint := Fingerprint(key)
+	for _, record := range records {
+		if record.Algorithm == algorithm && record.Type == TypeSHA256 && bytes.Equal(record.Fingerprint, fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier checks host keys against SSHFP records before handing them on to
+// another host key callback.
+type Verifier struct {
+	// Resolver defaults to a DNSResolver using the system name servers.
+	Resolver Resolver
+
+	// Confirm leaves the decision to the fallback even when a secure match is
+	// found, like VerifyHostKeyDNS=ask.
+	Confirm bool
+}
+
+// HostKeyCallback accepts host keys matching a DNSSEC secured SSHFP record
+// and passes everything else to fallback. Matches from insecure answers are
+// reported but never trusted on their own.
+func (v *Verifier) HostKeyCallback(fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = &DNSResolver{}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host := hostname
+		if h, _, err := net.SplitHostPort(hostname); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+
+		// Addresses have no SSHFP records of their own
+		if net.ParseIP(host) != nil {
+			return fallback(hostname, remote, key)
+		}
+
+		records, secure, err := resolver.LookupSSHFP(host)
+		if err != nil {
+			log.Printf("unable to look up SSHFP records for %s: %v", host, err)
+			return fallback(hostname, remote, key)
+		}
+
+		if !Match(records, key) {
+			if len(records) > 0 {
+				log.Printf("no matching host key fingerprint found in DNS for %s", host)
+			}
+			return fallback(hostname, remote, key)
+		}
+
+		if !secure {
+			log.Printf("matching host key fingerprint found in DNS for %s, but the answer was not secured with DNSSEC", host)
+			return fallback(hostname, remote, key)
+		}
+
+		if v.Confirm {
+			log.Printf("matching host key fingerprint found in DNS for %s", host)
+			return fallback(hostname, remote, key)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,172 @@
+package sshfp_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/freman/sshcode/sshfp"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeResolver struct {
+	records map[string][]sshfp.Record
+	secure  bool
+	err     error
+	lookups []string
+}
+
+func (r *fakeResolver) LookupSSHFP(host string) ([]sshfp.Record, bool, error) {
+	r.lookups = append(r.lookups, host)
+	return r.records[host], r.secure, r.err
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifier(t *testing.T) {
+	key := newHostKey(t)
+	other := newHostKey(t)
+
+	matching := []sshfp.Record{{Algorithm: sshfp.AlgorithmEd25519, Type: sshfp.TypeSHA256, Fingerprint: sshfp.Fingerprint(key)}}
+	errFallback := errors.New("fallback")
+
+	tests := []struct {
+		name     string
+		hostname string
+		records  []sshfp.Record
+		secure   bool
+		confirm  bool
+		err      error
+		fallback bool
+		lookup   string
+	}{
+		{name: "secure match", hostname: "host.example:22", records: matching, secure: true, lookup: "host.example"},
+		{name: "insecure match", hostname: "host.example:22", records: matching, fallback: true, lookup: "host.example"},
+		{name: "confirm", hostname: "host.example:22", records: matching, secure: true, confirm: true, fallback: true, lookup: "host.example"},
+		{name: "no records", hostname: "host.example:22", secure: true, fallback: true, lookup: "host.example"},
+		{name: "other key", hostname: "host.example:22", records: []sshfp.Record{{Algorithm: sshfp.AlgorithmEd25519, Type: sshfp.TypeSHA256, Fingerprint: sshfp.Fingerprint(other)}}, secure: true, fallback: true, lookup: "host.example"},
+		{name: "other algorithm", hostname: "host.example:22", records: []sshfp.Record{{Algorithm: sshfp.AlgorithmRSA, Type: sshfp.TypeSHA256, Fingerprint: sshfp.Fingerprint(key)}}, secure: true, fallback: true, lookup: "host.example"},
+		{name: "sha1 only", hostname: "host.example:22", records: []sshfp.Record{{Algorithm: sshfp.AlgorithmEd25519, Type: 1, Fingerprint: sshfp.Fingerprint(key)[:20]}}, secure: true, fallback: true, lookup: "host.example"},
+		{name: "lookup error", hostname: "host.example:22", secure: true, err: errors.New("timeout"), fallback: true, lookup: "host.example"},
+		{name: "address", hostname: "[::1]:2222", records: matching, secure: true, fallback: true},
+		{name: "no port", hostname: "host.example", records: matching, secure: true, lookup: "host.example"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &fakeResolver{
+				records: map[string][]sshfp.Record{"host.example": test.records, "::1": test.records},
+				secure:  test.secure,
+				err:     test.err,
+			}
+			verifier := &sshfp.Verifier{Resolver: resolver, Confirm: test.confirm}
+
+			var fellBack bool
+			callback := verifier.HostKeyCallback(func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+				fellBack = true
+				return errFallback
+			})
+
+			err := callback(test.hostname, nil, key)
+			if fellBack != test.fallback {
+				t.Errorf("fallback called = %v, want %v", fellBack, test.fallback)
+			}
+			if test.fallback && err != errFallback {
+				t.Errorf("got error %v, want the fallback's", err)
+			}
+			if !test.fallback && err != nil {
+				t.Errorf("got error %v, want key accepted", err)
+			}
+
+			if test.lookup == "" && len(resolver.lookups) > 0 {
+				t.Errorf("looked up %v, want no lookups", resolver.lookups)
+			} else if test.lookup != "" && (len(resolver.lookups) != 1 || resolver.lookups[0] != test.lookup) {
+				t.Errorf("looked up %v, want [%s]", resolver.lookups, test.lookup)
+			}
+		})
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	key := newHostKey(t)
+	fingerprint := hex.EncodeToString(sshfp.Fingerprint(key))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		question := req.Question[0]
+		switch {
+		case question.Name == "host.example." && question.Qtype == dns.TypeSSHFP:
+			resp.AuthenticatedData = true
+			resp.Answer = append(resp.Answer,
+				&dns.SSHFP{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSSHFP, Class: dns.ClassINET, Ttl: 60}, Algorithm: sshfp.AlgorithmEd25519, Type: sshfp.TypeSHA256, FingerPrint: fingerprint},
+				&dns.SSHFP{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSSHFP, Class: dns.ClassINET, Ttl: 60}, Algorithm: sshfp.AlgorithmRSA, Type: 1, FingerPrint: "00112233445566778899aabbccddeeff00112233"},
+			)
+		case question.Name == "insecure.example.":
+			resp.Answer = append(resp.Answer,
+				&dns.SSHFP{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSSHFP, Class: dns.ClassINET, Ttl: 60}, Algorithm: sshfp.AlgorithmEd25519, Type: sshfp.TypeSHA256, FingerPrint: fingerprint},
+			)
+		default:
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp)
+	})}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	resolver := &sshfp.DNSResolver{Servers: []string{conn.LocalAddr().String()}}
+
+	records, secure, err := resolver.LookupSSHFP("host.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure {
+		t.Error("answer for host.example should be secure")
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if !sshfp.Match(records, key) {
+		t.Error("records for host.example should match the host key")
+	}
+
+	records, secure, err = resolver.LookupSSHFP("insecure.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secure || !sshfp.Match(records, key) {
+		t.Errorf("insecure.example: secure = %v, match = %v, want an insecure match", secure, sshfp.Match(records, key))
+	}
+
+	records, _, err = resolver.LookupSSHFP("missing.example")
+	if err != nil || len(records) != 0 {
+		t.Errorf("missing.example: got %v, %v, want no records", records, err)
+	}
+}
@@ -0,0 +1,720 @@
+package tunnels_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/tunnels"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is a minimal in-process ssh server supporting direct-tcpip
+// channels, which end up at an echo server unless there's a matching target,
+// tcpip-forward requests and their Unix socket equivalents.
+type testServer struct {
+	mu        sync.Mutex
+	dialed    []string
+	cancelled int
+	echo      net.Listener
+	targets   map[string]string
+}
+
+func (s *testServer) lastDialed() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dialed) == 0 {
+		return ""
+	}
+	return s.dialed[len(s.dialed)-1]
+}
+
+func (s *testServer) forwardsCancelled() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancelled
+}
+
+func newTestServer(t *testing.T) (*testServer, *ssh.Client) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		listener.Close()
+		echo.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	reply, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reply.Close() })
+
+	go serveReplies(reply)
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s%s", r.Method, r.Host, r.URL)
+	}))
+	t.Cleanup(web.Close)
+
+	server := &testServer{
+		echo: echo,
+		targets: map[string]string{
+			"web.example":       web.Listener.Addr().String(),
+			"halfclose.example": reply.Addr().String(),
+		},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return server, client
+}
+
+func (s *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				s.forward(serverConn, req)
+			case "streamlocal-forward@openssh.com":
+				s.forwardStreamLocal(serverConn, req)
+			case "cancel-tcpip-forward", "cancel-streamlocal-forward@openssh.com":
+				s.mu.Lock()
+				s.cancelled++
+				s.mu.Unlock()
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "direct-tcpip":
+			s.directTCPIP(newChan)
+		case "direct-streamlocal@openssh.com":
+			s.directStreamLocal(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func (s *testServer) directTCPIP(newChan ssh.NewChannel) {
+	var msg struct {
+		Raddr string
+		Rport uint32
+		Laddr string
+		Lport uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.dialed = append(s.dialed, net.JoinHostPort(msg.Raddr, strconv.Itoa(int(msg.Rport))))
+	s.mu.Unlock()
+
+	switch msg.Raddr {
+	case "refused.example":
+		newChan.Reject(ssh.ConnectionFailed, "Connection refused")
+		return
+	case "prohibited.example":
+		newChan.Reject(ssh.Prohibited, "administratively prohibited")
+		return
+	}
+
+	targetAddr, ok := s.targets[msg.Raddr]
+	if !ok {
+		targetAddr = s.echo.Addr().String()
+	}
+
+	s.connect(newChan, "tcp", targetAddr)
+}
+
+// directStreamLocal connects a direct-streamlocal@openssh.com channel to the
+// Unix socket it asks for.
+func (s *testServer) directStreamLocal(newChan ssh.NewChannel) {
+	var msg struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.dialed = append(s.dialed, msg.SocketPath)
+	s.mu.Unlock()
+
+	s.connect(newChan, "unix", msg.SocketPath)
+}
+
+// connect accepts newChan once address can be reached and splices the two.
+func (s *testServer) connect(newChan ssh.NewChannel, network, address string) {
+	target, err := net.Dial(network, address)
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChan.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go splice(channel, target)
+}
+
+// forward handles a tcpip-forward request by listening locally and opening a
+// forwarded-tcpip channel for the first connection accepted.
+func (s *testServer) forward(serverConn *ssh.ServerConn, req *ssh.Request) {
+	var msg struct {
+		Addr string
+		Port uint32
+	}
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		channel, requests, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{msg.Addr, port, origin.IP.String(), uint32(origin.Port)}))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		splice(channel, conn)
+	}()
+}
+
+// serveReplies answers each connection accepted on listener once the whole
+// request has been read, like protocols that half close after sending.
+func serveReplies(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			request, _ := ioutil.ReadAll(conn)
+			conn.Write(append([]byte("got "), request...))
+		}()
+	}
+}
+
+// forwardStreamLocal handles a streamlocal-forward@openssh.com request by
+// listening on the Unix socket asked for and opening a
+// forwarded-streamlocal@openssh.com channel for the first connection accepted.
+func (s *testServer) forwardStreamLocal(serverConn *ssh.ServerConn, req *ssh.Request) {
+	var msg struct {
+		SocketPath string
+	}
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	listener, err := net.Listen("unix", msg.SocketPath)
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, nil)
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		channel, requests, err := serverConn.OpenChannel("forwarded-streamlocal@openssh.com", ssh.Marshal(struct {
+			SocketPath string
+			Reserved   string
+		}{msg.SocketPath, ""}))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		splice(channel, conn)
+	}()
+}
+
+// splice copies between channel and conn, passing on half closes, until both
+// directions are done.
+func splice(channel ssh.Channel, conn net.Conn) {
+	defer channel.Close()
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(channel, conn); channel.CloseWrite(); done <- struct{}{} }()
+	go func() { io.Copy(conn, channel); conn.(closeWriter).CloseWrite(); done <- struct{}{} }()
+	<-done
+	<-done
+}
+
+func newDynamicTunnel(t *testing.T, credentials tunnels.Credentials) (*testServer, string) {
+	t.Helper()
+
+	server, client := newTestServer(t)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+
+	tunnel, err := mgr.Dynamic("test", tunnels.Endpoint{Host: "127.0.0.1"}, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mgr.Close)
+
+	return server, tunnel.Local.String()
+}
+
+func dialProxy(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func expect(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("reading %v: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+// readSocks5Reply reads a SOCKS5 reply, returning the status and bound address.
+func readSocks5Reply(t *testing.T, r io.Reader) (byte, *net.TCPAddr) {
+	t.Helper()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+
+	var addr []byte
+	switch header[3] {
+	case 1:
+		addr = make([]byte, 4+2)
+	case 4:
+		addr = make([]byte, 16+2)
+	default:
+		t.Fatalf("unexpected address type %d in reply", header[3])
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		t.Fatalf("reading reply address: %v", err)
+	}
+
+	return header[1], &net.TCPAddr{
+		IP:   net.IP(addr[:len(addr)-2]),
+		Port: int(binary.BigEndian.Uint16(addr[len(addr)-2:])),
+	}
+}
+
+func socks5Domain(command byte, name string, port uint16) []byte {
+	request := append([]byte{5, command, 0, 3, byte(len(name))}, name...)
+	return append(request, byte(port>>8), byte(port))
+}
+
+func TestDynamicTunnelSOCKS5(t *testing.T) {
+	t.Parallel()
+
+	server, addr := newDynamicTunnel(t, nil)
+
+	tests := []struct {
+		name       string
+		request    []byte
+		wantStatus byte
+		wantDialed string
+	}{
+		{
+			name:       "ipv4",
+			request:    []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80},
+			wantStatus: 0x00,
+			wantDialed: "10.0.0.1:80",
+		},
+		{
+			name:       "ipv6",
+			request:    append(append([]byte{5, 1, 0, 4}, net.ParseIP("fd00::1")...), 1, 187),
+			wantStatus: 0x00,
+			wantDialed: "[fd00::1]:443",
+		},
+		{
+			name:       "domain is resolved remotely",
+			request:    socks5Domain(1, "internal.example", 8080),
+			wantStatus: 0x00,
+			wantDialed: "internal.example:8080",
+		},
+		{
+			name:       "connection refused",
+			request:    socks5Domain(1, "refused.example", 80),
+			wantStatus: 0x05,
+		},
+		{
+			name:       "not allowed",
+			request:    socks5Domain(1, "prohibited.example", 80),
+			wantStatus: 0x02,
+		},
+		{
+			name:       "unsupported address type",
+			request:    []byte{5, 1, 0, 9, 0, 0},
+			wantStatus: 0x08,
+		},
+		{
+			name:       "udp associate",
+			request:    []byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0},
+			wantStatus: 0x07,
+		},
+		{
+			name:       "unknown command",
+			request:    []byte{5, 9, 0, 1, 0, 0, 0, 0, 0, 0},
+			wantStatus: 0x07,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialProxy(t, addr)
+
+			conn.Write([]byte{5, 1, 0})
+			expect(t, conn, []byte{5, 0})
+
+			conn.Write(test.request)
+			status, _ := readSocks5Reply(t, conn)
+			if status != test.wantStatus {
+				t.Fatalf("expected status %#x, got %#x", test.wantStatus, status)
+			}
+
+			if test.wantStatus != 0 {
+				return
+			}
+
+			if dialed := server.lastDialed(); dialed != test.wantDialed {
+				t.Errorf("expected server to dial %s, got %s", test.wantDialed, dialed)
+			}
+
+			conn.Write([]byte("ping"))
+			expect(t, conn, []byte("ping"))
+		})
+	}
+}
+
+func TestDynamicTunnelSOCKS5NoAcceptableAuth(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newDynamicTunnel(t, nil)
+	conn := dialProxy(t, addr)
+
+	conn.Write([]byte{5, 1, 2})
+	expect(t, conn, []byte{5, 0xff})
+}
+
+func TestDynamicTunnelSOCKS5Bind(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newDynamicTunnel(t, nil)
+	conn := dialProxy(t, addr)
+
+	conn.Write([]byte{5, 1, 0})
+	expect(t, conn, []byte{5, 0})
+
+	conn.Write([]byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 0})
+	status, bound := readSocks5Reply(t, conn)
+	if status != 0 {
+		t.Fatalf("expected first BIND reply to succeed, got %#x", status)
+	}
+	if bound.Port == 0 {
+		t.Fatal("expected a bound port in the first BIND reply")
+	}
+	if !bound.IP.IsLoopback() {
+		t.Errorf("expected the server to listen on loopback, got %s", bound.IP)
+	}
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bound.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	status, origin := readSocks5Reply(t, conn)
+	if status != 0 {
+		t.Fatalf("expected second BIND reply to succeed, got %#x", status)
+	}
+	if origin.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("expected second BIND reply to report peer %s, got %s", peer.LocalAddr(), origin)
+	}
+
+	peer.Write([]byte("pong"))
+	expect(t, conn, []byte("pong"))
+}
+
+func TestDynamicTunnelSOCKS5BindClientGone(t *testing.T) {
+	t.Parallel()
+
+	server, addr := newDynamicTunnel(t, nil)
+	conn := dialProxy(t, addr)
+
+	conn.Write([]byte{5, 1, 0})
+	expect(t, conn, []byte{5, 0})
+
+	conn.Write([]byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 0})
+	if status, _ := readSocks5Reply(t, conn); status != 0 {
+		t.Fatalf("expected first BIND reply to succeed, got %#x", status)
+	}
+
+	// Leaving before the peer connects gives up the remote listener
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.forwardsCancelled() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the remote listener to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDynamicTunnelSOCKS4(t *testing.T) {
+	t.Parallel()
+
+	server, addr := newDynamicTunnel(t, nil)
+	conn := dialProxy(t, addr)
+
+	conn.Write([]byte{4, 1, 0, 22, 192, 168, 1, 1, 'b', 'o', 'b', 0})
+	expect(t, conn, []byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+
+	if dialed := server.lastDialed(); dialed != "192.168.1.1:22" {
+		t.Errorf("expected server to dial 192.168.1.1:22, got %s", dialed)
+	}
+
+	conn.Write([]byte("ping"))
+	expect(t, conn, []byte("ping"))
+}
+
+func TestDynamicTunnelSOCKS4a(t *testing.T) {
+	t.Parallel()
+
+	server, addr := newDynamicTunnel(t, nil)
+	conn := dialProxy(t, addr)
+
+	request := []byte{4, 1, 0, 80, 0, 0, 0, 1}
+	request = append(request, "bob\x00internal.example\x00"...)
+	conn.Write(request)
+	expect(t, conn, []byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+
+	if dialed := server.lastDialed(); dialed != "internal.example:80" {
+		t.Errorf("expected server to dial internal.example:80, got %s", dialed)
+	}
+
+	conn.Write([]byte("ping"))
+	expect(t, conn, []byte("ping"))
+}
+
+func TestDynamicTunnelSOCKS4LongFields(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("a", 255)
+
+	tests := []struct {
+		name    string
+		request string
+		status  byte
+	}{
+		{"longest user", "\x00\x00\x00\x01" + long + "\x00internal.example\x00", 0x5a},
+		{"longest host", "\x00\x00\x00\x01bob\x00" + long + "\x00", 0x5a},
+		{"user too long", "\xc0\xa8\x01\x01" + long + "a\x00", 0x5b},
+		{"host too long", "\x00\x00\x00\x01bob\x00" + long + "a\x00", 0x5b},
+	}
+
+	_, addr := newDynamicTunnel(t, nil)
+
+	for _, test := range tests {
+		conn := dialProxy(t, addr)
+		conn.Write(append([]byte{4, 1, 0, 80}, test.request...))
+
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Errorf("%s: reading reply: %v", test.name, err)
+			continue
+		}
+		if reply[1] != test.status {
+			t.Errorf("%s: expected status %#x, got %#x", test.name, test.status, reply[1])
+		}
+	}
+}
+
+func TestDynamicTunnelAuthentication(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newDynamicTunnel(t, tunnels.Credentials{"bob": "hunter2"})
+
+	auth := func(user, password string) []byte {
+		request := append([]byte{1, byte(len(user))}, user...)
+		request = append(request, byte(len(password)))
+		return append(request, password...)
+	}
+
+	tests := []struct {
+		name      string
+		handshake []byte
+		want      []byte
+		connect   bool
+	}{
+		{
+			name:      "valid password",
+			handshake: append([]byte{5, 2, 0, 2}, auth("bob", "hunter2")...),
+			want:      []byte{5, 2, 1, 0},
+			connect:   true,
+		},
+		{
+			name:      "wrong password",
+			handshake: append([]byte{5, 1, 2}, auth("bob", "hunter3")...),
+			want:      []byte{5, 2, 1, 1},
+		},
+		{
+			name:      "unknown user",
+			handshake: append([]byte{5, 1, 2}, auth("alice", "hunter2")...),
+			want:      []byte{5, 2, 1, 1},
+		},
+		{
+			name:      "no authentication offered",
+			handshake: []byte{5, 1, 0},
+			want:      []byte{5, 0xff},
+		},
+		{
+			name:      "socks4 rejected",
+			handshake: []byte{4, 1, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0},
+			want:      []byte{0, 0x5b, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialProxy(t, addr)
+
+			conn.Write(test.handshake)
+			expect(t, conn, test.want)
+
+			if !test.connect {
+				return
+			}
+
+			conn.Write(socks5Domain(1, "internal.example", 80))
+			if status, _ := readSocks5Reply(t, conn); status != 0 {
+				t.Fatalf("expected CONNECT to succeed, got %#x", status)
+			}
+		})
+	}
+}
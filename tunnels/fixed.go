@@ -1,22 +1,20 @@
 package tunnels
 
 import (
-	"io"
+	"log"
 	"net"
 )
 
 type FixedTunnel struct {
-	name     string
-	listener net.Listener
-	manager  *Manager
-	shutdown chan struct{}
-	Local    Endpoint
-	Remote   Endpoint
+	name    string
+	manager *Manager
+	*closer
+	Local  Endpoint
+	Remote Endpoint
 }
 
 func (t *FixedTunnel) Run() {
 	defer t.Close()
-	t.shutdown = make(chan struct{})
 
 	for {
 		conn, err := t.listener.Accept()
@@ -29,26 +27,19 @@ func (t *FixedTunnel) Run() {
 }
 
 func (t *FixedTunnel) Close() {
-	if t.listener != nil {
-		t.listener.Close()
-		t.manager.unregister <- t
-		close(t.shutdown)
-		t.listener = nil
-	}
+	t.close(t.manager, t)
 }
 
 func (t *FixedTunnel) forward(localConn net.Conn) {
 	defer localConn.Close()
-	remoteConn, err := t.manager.client.Dial("tcp", t.Remote.String())
+	remoteConn, err := t.manager.client.Dial(t.Remote.network(), t.Remote.String())
 	if err != nil {
+		log.Printf("[%s] unable to connect to %s: %v", t.name, t.Remote, err)
 		return
 	}
 	defer remoteConn.Close()
 
-	go io.Copy(localConn, remoteConn)
-	go io.Copy(remoteConn, localConn)
-
-	<-t.shutdown
+	pipe(localConn, remoteConn, t.shutdown)
 }
 
 func (t *FixedTunnel) Name() string {
@@ -0,0 +1,80 @@
+package tunnels_test
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/tunnels"
+)
+
+// listenReplies serves replies on a Unix socket at path for the rest of the
+// test.
+func listenReplies(t *testing.T, path string) {
+	t.Helper()
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveReplies(listener)
+}
+
+func dialUnix(t *testing.T, path string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestFixedTunnelUnix(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestServer(t)
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.sock")
+	listenReplies(t, target)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+	t.Cleanup(mgr.Close)
+
+	tests := []struct {
+		name  string
+		local tunnels.Endpoint
+	}{
+		{"tcp to unix", tunnels.Endpoint{Host: "127.0.0.1"}},
+		{"unix to unix", tunnels.Endpoint{Network: "unix", Path: filepath.Join(dir, "local.sock")}},
+	}
+
+	for _, test := range tests {
+		tunnel, err := mgr.Fixed(test.name, test.local, tunnels.Endpoint{Network: "unix", Path: target})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var conn net.Conn
+		if test.local.Network == "unix" {
+			conn = dialUnix(t, tunnel.Local.Path)
+		} else {
+			conn = dialProxy(t, tunnel.Local.String())
+		}
+
+		// Connections are sent over direct-streamlocal@openssh.com channels
+		if response := halfClose(t, conn, "request"); response != "got request" {
+			t.Errorf("%s: expected the remote socket to answer, got %q", test.name, response)
+		}
+		if dialed := server.lastDialed(); dialed != target {
+			t.Errorf("%s: expected the server to connect to %s, got %s", test.name, target, dialed)
+		}
+	}
+}
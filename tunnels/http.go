@@ -0,0 +1,249 @@
+package tunnels
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type HTTPProxyTunnel struct {
+	name    string
+	manager *Manager
+	*closer
+	credentials Credentials
+	Local       Endpoint
+}
+
+func (t *HTTPProxyTunnel) Run() {
+	defer t.Close()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go t.forward(conn)
+	}
+}
+
+func (t *HTTPProxyTunnel) Close() {
+	t.close(t.manager, t)
+}
+
+func (t *HTTPProxyTunnel) forward(localConn net.Conn) {
+	defer localConn.Close()
+	serveHTTPProxy(t.manager, bufferedConn{Reader: bufio.NewReader(localConn), Conn: localConn}, t.credentials, t.shutdown)
+}
+
+func (t *HTTPProxyTunnel) Name() string {
+	return t.name
+}
+
+// hopHeaders are removed from requests and responses passing through the
+// proxy, as they only apply to a single connection.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// serveHTTPProxy serves HTTP proxy requests from localConn until it's closed,
+// tunnelling CONNECT requests and relaying absolute URI requests through the
+// server.
+func serveHTTPProxy(manager *Manager, localConn bufferedConn, credentials Credentials, shutdown <-chan struct{}) {
+	for {
+		req, err := http.ReadRequest(localConn.Reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[%s] unable to read HTTP proxy request: %v", localConn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if !httpProxyAuthorized(req, credentials) {
+			log.Printf("[%s] HTTP proxy authentication failed", localConn.RemoteAddr())
+			httpProxyError(localConn, req, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="sshcode"`},
+			})
+			io.Copy(ioutil.Discard, req.Body)
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			httpProxyConnect(manager, localConn, req, shutdown)
+			return
+		}
+
+		if !httpProxyRelay(manager, localConn, req) {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+	}
+}
+
+func httpProxyAuthorized(req *http.Request, credentials Credentials) bool {
+	if len(credentials) == 0 {
+		return true
+	}
+
+	// Borrow the parsing of basic credentials from the Authorization header
+	auth := &http.Request{Header: http.Header{"Authorization": {req.Header.Get("Proxy-Authorization")}}}
+	user, password, ok := auth.BasicAuth()
+	return ok && credentials.Valid(user, password)
+}
+
+// httpProxyAddr returns the host and port a proxy request is for.
+func httpProxyAddr(req *http.Request, defaultPort int) (string, int, error) {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if req.Method == http.MethodConnect {
+		host, port = req.Host, ""
+		if h, p, err := net.SplitHostPort(req.Host); err == nil {
+			host, port = h, p
+		}
+	}
+
+	if host == "" {
+		return "", 0, fmt.Errorf("no host in request for %q", req.RequestURI)
+	}
+
+	if port == "" {
+		return host, defaultPort, nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, p, nil
+}
+
+func httpProxyConnect(manager *Manager, localConn bufferedConn, req *http.Request, shutdown <-chan struct{}) {
+	host, port, err := httpProxyAddr(req, 443)
+	if err != nil {
+		log.Printf("[%s] bad HTTP CONNECT request: %v", localConn.RemoteAddr(), err)
+		httpProxyError(localConn, req, http.StatusBadRequest, nil)
+		return
+	}
+
+	log.Printf("[%s] incoming HTTP CONNECT request, raddr=%s", localConn.RemoteAddr(), net.JoinHostPort(host, strconv.Itoa(port)))
+
+	remoteConn, err := manager.dial(host, port)
+	if err != nil {
+		log.Printf("[%s] unable to connect to remote host: %v", localConn.RemoteAddr(), err)
+		httpProxyError(localConn, req, httpErrorStatus(err), nil)
+		return
+	}
+	defer remoteConn.Close()
+
+	io.WriteString(localConn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(localConn, remoteConn, shutdown)
+}
+
+// httpProxyRelay sends a single absolute URI request to its origin server and
+// copies the response back, returning false if the client connection should
+// be closed.
+func httpProxyRelay(manager *Manager, localConn bufferedConn, req *http.Request) bool {
+	if req.URL.Scheme != "http" {
+		log.Printf("[%s] unsupported HTTP proxy request for %q", localConn.RemoteAddr(), req.RequestURI)
+		httpProxyError(localConn, req, http.StatusBadRequest, nil)
+		return false
+	}
+
+	host, port, err := httpProxyAddr(req, 80)
+	if err != nil {
+		log.Printf("[%s] bad HTTP proxy request: %v", localConn.RemoteAddr(), err)
+		httpProxyError(localConn, req, http.StatusBadRequest, nil)
+		return false
+	}
+
+	log.Printf("[%s] incoming HTTP proxy request, method=%s, url=%s", localConn.RemoteAddr(), req.Method, req.URL)
+
+	remoteConn, err := manager.dial(host, port)
+	if err != nil {
+		log.Printf("[%s] unable to connect to remote host: %v", localConn.RemoteAddr(), err)
+		httpProxyError(localConn, req, httpErrorStatus(err), nil)
+		return !req.Close
+	}
+	defer remoteConn.Close()
+
+	clientClose := req.Close || req.Header.Get("Proxy-Connection") == "close"
+	removeHopHeaders(req.Header)
+	req.Close = true
+
+	if err := req.Write(remoteConn); err != nil {
+		log.Printf("[%s] unable to send HTTP proxy request: %v", localConn.RemoteAddr(), err)
+		httpProxyError(localConn, req, http.StatusBadGateway, nil)
+		return false
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(remoteConn), req)
+	if err != nil {
+		log.Printf("[%s] unable to read HTTP proxy response: %v", localConn.RemoteAddr(), err)
+		httpProxyError(localConn, req, http.StatusBadGateway, nil)
+		return false
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	resp.Close = clientClose
+
+	if err := resp.Write(localConn); err != nil {
+		return false
+	}
+
+	return !clientClose
+}
+
+func httpProxyError(w io.Writer, req *http.Request, status int, header http.Header) {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	body := http.StatusText(status) + "\n"
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	resp.Write(w)
+}
+
+// httpErrorStatus maps errors from the ssh server to HTTP status codes.
+func httpErrorStatus(err error) int {
+	if err, isa := err.(*ssh.OpenChannelError); isa && err.Reason == ssh.Prohibited {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,137 @@
+package tunnels_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/freman/sshcode/tunnels"
+)
+
+func newHTTPProxyTunnel(t *testing.T, credentials tunnels.Credentials) string {
+	t.Helper()
+
+	_, client := newTestServer(t)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+
+	tunnel, err := mgr.HTTPProxy("test", tunnels.Endpoint{Host: "127.0.0.1"}, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mgr.Close)
+
+	return tunnel.Local.String()
+}
+
+func TestHTTPProxyTunnel(t *testing.T) {
+	t.Parallel()
+
+	_, dynamicAddr := newDynamicTunnel(t, nil)
+	httpAddr := newHTTPProxyTunnel(t, nil)
+	authAddr := newHTTPProxyTunnel(t, tunnels.Credentials{"bob": "hunter2"})
+
+	tests := []struct {
+		name       string
+		addr       string
+		request    string
+		wantStatus int
+		wantBody   string
+		echo       bool
+	}{
+		{
+			name:       "connect",
+			addr:       httpAddr,
+			request:    "CONNECT internal.example:22 HTTP/1.1\r\nHost: internal.example:22\r\n\r\n",
+			wantStatus: http.StatusOK,
+			echo:       true,
+		},
+		{
+			name:       "connect on dynamic listener",
+			addr:       dynamicAddr,
+			request:    "CONNECT internal.example:22 HTTP/1.1\r\nHost: internal.example:22\r\n\r\n",
+			wantStatus: http.StatusOK,
+			echo:       true,
+		},
+		{
+			name:       "connect prohibited",
+			addr:       httpAddr,
+			request:    "CONNECT prohibited.example:22 HTTP/1.1\r\nHost: prohibited.example:22\r\n\r\n",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "absolute uri",
+			addr:       httpAddr,
+			request:    "GET http://web.example/hello?name=bob HTTP/1.1\r\nHost: web.example\r\nProxy-Connection: close\r\n\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   "GET web.example/hello?name=bob",
+		},
+		{
+			name:       "absolute uri on dynamic listener",
+			addr:       dynamicAddr,
+			request:    "GET http://web.example/ HTTP/1.1\r\nHost: web.example\r\nProxy-Connection: close\r\n\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   "GET web.example/",
+		},
+		{
+			name:       "authentication required",
+			addr:       authAddr,
+			request:    "CONNECT internal.example:22 HTTP/1.1\r\nHost: internal.example:22\r\n\r\n",
+			wantStatus: http.StatusProxyAuthRequired,
+		},
+		{
+			name:       "wrong password",
+			addr:       authAddr,
+			request:    "CONNECT internal.example:22 HTTP/1.1\r\nHost: internal.example:22\r\nProxy-Authorization: Basic Ym9iOmh1bnRlcjM=\r\n\r\n",
+			wantStatus: http.StatusProxyAuthRequired,
+		},
+		{
+			name:       "authenticated",
+			addr:       authAddr,
+			request:    "CONNECT internal.example:22 HTTP/1.1\r\nHost: internal.example:22\r\nProxy-Authorization: Basic Ym9iOmh1bnRlcjI=\r\n\r\n",
+			wantStatus: http.StatusOK,
+			echo:       true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialProxy(t, test.addr)
+			reader := bufio.NewReader(conn)
+
+			fmt.Fprint(conn, test.request)
+
+			resp, err := http.ReadResponse(reader, &http.Request{Method: strings.Fields(test.request)[0]})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("expected status %d, got %d", test.wantStatus, resp.StatusCode)
+			}
+
+			if test.echo {
+				conn.Write([]byte("ping"))
+				expect(t, reader, []byte("ping"))
+				return
+			}
+
+			if test.wantBody == "" {
+				return
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.wantBody {
+				t.Errorf("expected body %q, got %q", test.wantBody, body)
+			}
+		})
+	}
+}
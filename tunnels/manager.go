@@ -3,6 +3,7 @@ package tunnels
 import (
 	"fmt"
 	"net"
+	"strconv"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -12,6 +13,7 @@ type Manager struct {
 	tunnels    map[Tunnel]struct{}
 	register   chan Tunnel
 	unregister chan Tunnel
+	closeAll   chan chan []Tunnel
 }
 
 func NewManager(c *ssh.Client) *Manager {
@@ -19,47 +21,124 @@ func NewManager(c *ssh.Client) *Manager {
 		client:     c,
 		register:   make(chan Tunnel),
 		unregister: make(chan Tunnel),
+		closeAll:   make(chan chan []Tunnel),
 		tunnels:    make(map[Tunnel]struct{}),
 	}
 }
 
-func (m *Manager) Fixed(name string, local, remote Endpoint) error {
+func (m *Manager) Fixed(name string, local, remote Endpoint) (*FixedTunnel, error) {
+	listener, err := net.Listen(local.network(), local.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, isa := listener.Addr().(*net.TCPAddr); isa {
+		local.Port = addr.Port
+	}
+
+	tunnel := &FixedTunnel{
+		name:    name,
+		Local:   local,
+		Remote:  remote,
+		manager: m,
+		closer:  newCloser(listener),
+	}
+
+	m.register <- tunnel
+	go tunnel.Run()
+
+	return tunnel, nil
+}
+
+// Dynamic starts a SOCKS proxy on local. When credentials are given clients
+// must authenticate with one of them.
+func (m *Manager) Dynamic(name string, local Endpoint, credentials Credentials) (*DynamicTunnel, error) {
 	listener, err := net.Listen("tcp", local.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	local.Port = listener.Addr().(*net.TCPAddr).Port
 
-	tunnel := FixedTunnel{
-		Local:    local,
-		Remote:   remote,
-		manager:  m,
-		listener: listener,
+	tunnel := &DynamicTunnel{
+		name:        name,
+		Local:       local,
+		credentials: credentials,
+		manager:     m,
+		closer:      newCloser(listener),
 	}
 
+	m.register <- tunnel
 	go tunnel.Run()
 
-	return nil
+	return tunnel, nil
 }
 
-func (m *Manager) Dynamic(name string, local Endpoint) error {
+// Remote asks the server to listen on remote and forwards connections it
+// accepts to local.
+func (m *Manager) Remote(name string, remote, local Endpoint) (*RemoteTunnel, error) {
+	listener, err := m.client.Listen(remote.network(), remote.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, isa := listener.Addr().(*net.TCPAddr); isa {
+		remote.Port = addr.Port
+	}
+
+	tunnel := &RemoteTunnel{
+		name:    name,
+		Remote:  remote,
+		Local:   local,
+		manager: m,
+		closer:  newCloser(listener),
+	}
+
+	m.register <- tunnel
+	go tunnel.Run()
+
+	return tunnel, nil
+}
+
+// HTTPProxy starts an HTTP proxy supporting CONNECT and absolute URI requests
+// on local. When credentials are given clients must authenticate with one of
+// them.
+func (m *Manager) HTTPProxy(name string, local Endpoint, credentials Credentials) (*HTTPProxyTunnel, error) {
 	listener, err := net.Listen("tcp", local.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	local.Port = listener.Addr().(*net.TCPAddr).Port
 
-	tunnel := DynamicTunnel{
-		Local:    local,
-		manager:  m,
-		listener: listener,
+	tunnel := &HTTPProxyTunnel{
+		name:        name,
+		Local:       local,
+		credentials: credentials,
+		manager:     m,
+		closer:      newCloser(listener),
 	}
 
+	m.register <- tunnel
 	go tunnel.Run()
 
-	return nil
+	return tunnel, nil
+}
+
+// dial opens a connection to host and port from the server, leaving any name
+// resolution to the server.
+func (m *Manager) dial(host string, port int) (net.Conn, error) {
+	return m.client.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Close closes all registered tunnels. Each tunnel unregisters itself as it
+// closes, so this must not be called from the manager's own goroutine.
+func (m *Manager) Close() {
+	reply := make(chan []Tunnel)
+	m.closeAll <- reply
+	for _, tun := range <-reply {
+		tun.Close()
+	}
 }
 
 func (m *Manager) Run() {
@@ -69,11 +148,17 @@ func (m *Manager) Run() {
 			fmt.Println("[tunnels] Registering " + tun.Name())
 			m.tunnels[tun] = struct{}{}
 		case tun := <-m.unregister:
+			// Sent by the tunnel as it closes, so it's only forgotten here
 			fmt.Println("[tunnels] Unegistering " + tun.Name())
-			if _, ok := m.tunnels[tun]; ok {
+			delete(m.tunnels, tun)
+		case reply := <-m.closeAll:
+			fmt.Println("[tunnels] Closing all tunnels")
+			var tuns []Tunnel
+			for tun := range m.tunnels {
 				delete(m.tunnels, tun)
-				tun.Close()
+				tuns = append(tuns, tun)
 			}
+			reply <- tuns
 		}
 	}
 }
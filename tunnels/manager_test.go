@@ -0,0 +1,106 @@
+package tunnels_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freman/sshcode/tunnels"
+)
+
+func TestTunnelCloseWhileAccepting(t *testing.T) {
+	t.Parallel()
+
+	_, client := newTestServer(t)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+
+	tunnel, err := mgr.Fixed("test",
+		tunnels.Endpoint{Host: "127.0.0.1"},
+		tunnels.Endpoint{Host: "echo.example", Port: 7},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run is blocked in Accept while everyone closes the tunnel at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tunnel.Close()
+		}()
+	}
+	wg.Wait()
+	tunnel.Close()
+
+	if conn, err := net.Dial("tcp", tunnel.Local.String()); err == nil {
+		conn.Close()
+		t.Error("expected the listener to be closed")
+	}
+
+	mgr.Close()
+}
+
+func TestManagerCloseWithLiveTunnels(t *testing.T) {
+	t.Parallel()
+
+	_, client := newTestServer(t)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+
+	fixed, err := mgr.Fixed("fixed",
+		tunnels.Endpoint{Host: "127.0.0.1"},
+		tunnels.Endpoint{Host: "echo.example", Port: 7},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamic, err := mgr.Dynamic("dynamic", tunnels.Endpoint{Host: "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := mgr.HTTPProxy("http", tunnels.Endpoint{Host: "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.Remote("remote", tunnels.Endpoint{Host: "127.0.0.1"}, fixed.Local); err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection in the middle of being piped
+	conn := dialProxy(t, fixed.Local.String())
+	conn.Write([]byte("ping"))
+	expect(t, conn, []byte("ping"))
+
+	closed := make(chan struct{})
+	go func() {
+		mgr.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out closing the manager")
+	}
+
+	for _, addr := range []string{fixed.Local.String(), dynamic.Local.String(), proxy.Local.String()} {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Errorf("expected the listener on %s to be closed", addr)
+		}
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the piped connection to be closed")
+	}
+
+	// Closing again, or a tunnel on its own, is harmless
+	mgr.Close()
+	fixed.Close()
+}
@@ -0,0 +1,47 @@
+package tunnels
+
+import (
+	"log"
+	"net"
+)
+
+type RemoteTunnel struct {
+	name    string
+	manager *Manager
+	*closer
+	Remote Endpoint
+	Local  Endpoint
+}
+
+func (t *RemoteTunnel) Run() {
+	defer t.Close()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go t.forward(conn)
+	}
+}
+
+func (t *RemoteTunnel) Close() {
+	t.close(t.manager, t)
+}
+
+func (t *RemoteTunnel) forward(remoteConn net.Conn) {
+	defer remoteConn.Close()
+	localConn, err := net.Dial(t.Local.network(), t.Local.String())
+	if err != nil {
+		log.Printf("[%s] unable to connect to %s: %v", t.name, t.Local, err)
+		return
+	}
+	defer localConn.Close()
+
+	pipe(remoteConn, localConn, t.shutdown)
+}
+
+func (t *RemoteTunnel) Name() string {
+	return t.name
+}
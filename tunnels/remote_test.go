@@ -0,0 +1,74 @@
+package tunnels_test
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/freman/sshcode/tunnels"
+)
+
+func TestRemoteTunnel(t *testing.T) {
+	t.Parallel()
+
+	_, client := newTestServer(t)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { local.Close() })
+	go serveReplies(local)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+	t.Cleanup(mgr.Close)
+
+	tunnel, err := mgr.Remote("remote",
+		tunnels.Endpoint{Host: "127.0.0.1"},
+		tunnels.Endpoint{Host: "127.0.0.1", Port: local.Addr().(*net.TCPAddr).Port},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Remote.Port == 0 {
+		t.Fatal("expected the port the server listens on to be filled in")
+	}
+
+	// The server opens a forwarded-tcpip channel for connections to its
+	// port, which the tunnel passes on to the local endpoint
+	conn := dialProxy(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.Remote.Port)))
+	if response := halfClose(t, conn, "request"); response != "got request" {
+		t.Errorf("expected the local endpoint to answer, got %q", response)
+	}
+}
+
+func TestRemoteTunnelUnix(t *testing.T) {
+	t.Parallel()
+
+	_, client := newTestServer(t)
+
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local.sock")
+	listenReplies(t, local)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+	t.Cleanup(mgr.Close)
+
+	tunnel, err := mgr.Remote("remote",
+		tunnels.Endpoint{Network: "unix", Path: filepath.Join(dir, "remote.sock")},
+		tunnels.Endpoint{Network: "unix", Path: local},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server listens after a streamlocal-forward@openssh.com request and
+	// opens a forwarded-streamlocal@openssh.com channel for connections
+	conn := dialUnix(t, tunnel.Remote.Path)
+	if response := halfClose(t, conn, "request"); response != "got request" {
+		t.Errorf("expected the local socket to answer, got %q", response)
+	}
+}
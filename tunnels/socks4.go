@@ -0,0 +1,100 @@
+package tunnels
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	// socks4MaxField limits the user ID and SOCKS4a host name, which have no
+	// length of their own
+	socks4MaxField = 255
+
+	socks4HandshakeTimeout = 30 * time.Second
+)
+
+var errSocks4FieldTooLong = errors.New("field too long")
+
+// readSocks4Field reads a NUL terminated field of at most socks4MaxField bytes.
+func readSocks4Field(r *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxField {
+			return "", errSocks4FieldTooLong
+		}
+		field = append(field, b)
+	}
+}
+
+func (t *DynamicTunnel) socks4(localConn bufferedConn) {
+	localConn.SetReadDeadline(time.Now().Add(socks4HandshakeTimeout))
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(localConn, header); err != nil {
+		log.Printf("[%s] unable to read SOCKS4 header: %v", localConn.RemoteAddr(), err)
+		return
+	}
+
+	user, err := readSocks4Field(localConn.Reader)
+	if err != nil {
+		log.Printf("[%s] unable to locate SOCKS4 user: %v", localConn.RemoteAddr(), err)
+		localConn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	port := int(binary.BigEndian.Uint16(header[2:4]))
+	ip := net.IP(header[4:8])
+	host := ip.String()
+
+	// SOCKS4a signals a host name follows the user with an address of 0.0.0.x
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readSocks4Field(localConn.Reader); err != nil {
+			log.Printf("[%s] unable to locate SOCKS4a host name: %v", localConn.RemoteAddr(), err)
+			localConn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+			return
+		}
+	}
+	localConn.SetReadDeadline(time.Time{})
+
+	// SOCKS4 has no passwords, so it can't be used once authentication is needed
+	if len(t.credentials) > 0 {
+		log.Printf("[%s] rejecting unauthenticated SOCKS4 request, user=%q", localConn.RemoteAddr(), user)
+		localConn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	switch command := header[1]; command {
+	case 1:
+		log.Printf("[%s] incoming SOCKS4 TCP/IP stream connection, user=%q, raddr=%s", localConn.RemoteAddr(), user, net.JoinHostPort(host, strconv.Itoa(port)))
+
+		remoteConn, err := t.dial(host, port)
+		if err != nil {
+			log.Printf("[%s] unable to connect to remote host: %v", localConn.RemoteAddr(), err)
+			localConn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer remoteConn.Close()
+
+		localConn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+		pipe(localConn, remoteConn, t.shutdown)
+	default:
+		log.Printf("[%s] unsupported command, closing connection", localConn.RemoteAddr())
+		localConn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+	}
+}
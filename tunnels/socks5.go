@@ -0,0 +1,319 @@
+package tunnels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthUnacceptable = 0xff
+
+	socks5PasswordVersion = 1
+	socks5PasswordSuccess = 0x00
+	socks5PasswordFailure = 0x01
+
+	socks5Connect      = 1
+	socks5Bind         = 2
+	socks5UDPAssociate = 3
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5Succeeded               = 0x00
+	socks5GeneralFailure          = 0x01
+	socks5NotAllowed              = 0x02
+	socks5HostUnreachable         = 0x04
+	socks5ConnectionRefused       = 0x05
+	socks5CommandNotSupported     = 0x07
+	socks5AddressTypeNotSupported = 0x08
+)
+
+var errSocks5AddressType = errors.New("unsupported SOCKS5 address type")
+
+func (t *DynamicTunnel) socks5(localConn bufferedConn) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(localConn, header); err != nil {
+		log.Printf("[%s] unable to read SOCKS5 header: %v", localConn.RemoteAddr(), err)
+		return
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(localConn, methods); err != nil {
+		log.Printf("[%s] unable to read SOCKS5 authentication methods: %v", localConn.RemoteAddr(), err)
+		return
+	}
+
+	if !t.socks5Authenticate(localConn, methods) {
+		return
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(localConn, request); err != nil {
+		log.Printf("[%s] unable to read SOCKS5 request: %v", localConn.RemoteAddr(), err)
+		return
+	}
+
+	if version := request[0]; version != socks5Version {
+		log.Printf("[%s] unknown version after SOCKS5 handshake: %d", localConn.RemoteAddr(), version)
+		socks5Reply(localConn, socks5GeneralFailure, nil)
+		return
+	}
+
+	host, port, err := readSocks5Addr(localConn)
+	if err == errSocks5AddressType {
+		log.Printf("[%s] %v", localConn.RemoteAddr(), err)
+		socks5Reply(localConn, socks5AddressTypeNotSupported, nil)
+		return
+	} else if err != nil {
+		log.Printf("[%s] corrupt SOCKS5 request: %v", localConn.RemoteAddr(), err)
+		return
+	}
+
+	switch command := request[1]; command {
+	case socks5Connect:
+		t.socks5Connect(localConn, host, port)
+	case socks5Bind:
+		t.socks5Bind(localConn, host, port)
+	case socks5UDPAssociate:
+		// There is no way to carry datagrams over an ssh channel
+		log.Printf("[%s] unsupported SOCKS5 UDP ASSOCIATE request", localConn.RemoteAddr())
+		socks5Reply(localConn, socks5CommandNotSupported, nil)
+	default:
+		log.Printf("[%s] unknown SOCKS5 command: %d", localConn.RemoteAddr(), command)
+		socks5Reply(localConn, socks5CommandNotSupported, nil)
+	}
+}
+
+// socks5Authenticate negotiates the authentication method with the client,
+// returning true if the request should proceed. Username/password
+// authentication (RFC 1929) is required whenever credentials are configured.
+func (t *DynamicTunnel) socks5Authenticate(localConn bufferedConn, methods []byte) bool {
+	want := byte(socks5AuthNone)
+	if len(t.credentials) > 0 {
+		want = socks5AuthPassword
+	}
+
+	if !bytes.Contains(methods, []byte{want}) {
+		log.Printf("[%s] unsupported SOCKS5 authentication method", localConn.RemoteAddr())
+		localConn.Write([]byte{socks5Version, socks5AuthUnacceptable})
+		return false
+	}
+
+	localConn.Write([]byte{socks5Version, want})
+	if want == socks5AuthNone {
+		return true
+	}
+
+	version, err := localConn.ReadByte()
+	if err != nil || version != socks5PasswordVersion {
+		log.Printf("[%s] corrupt SOCKS5 username/password request", localConn.RemoteAddr())
+		localConn.Write([]byte{socks5PasswordVersion, socks5PasswordFailure})
+		return false
+	}
+
+	user, err := readSocks5String(localConn)
+	if err != nil {
+		log.Printf("[%s] unable to read SOCKS5 user: %v", localConn.RemoteAddr(), err)
+		return false
+	}
+
+	password, err := readSocks5String(localConn)
+	if err != nil {
+		log.Printf("[%s] unable to read SOCKS5 password: %v", localConn.RemoteAddr(), err)
+		return false
+	}
+
+	if !t.credentials.Valid(user, password) {
+		log.Printf("[%s] SOCKS5 authentication failed for user=%q", localConn.RemoteAddr(), user)
+		localConn.Write([]byte{socks5PasswordVersion, socks5PasswordFailure})
+		return false
+	}
+
+	localConn.Write([]byte{socks5PasswordVersion, socks5PasswordSuccess})
+	return true
+}
+
+// readSocks5String reads a single byte length prefixed string.
+func readSocks5String(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+
+	str := make([]byte, length[0])
+	if _, err := io.ReadFull(r, str); err != nil {
+		return "", err
+	}
+
+	return string(str), nil
+}
+
+func (t *DynamicTunnel) socks5Connect(localConn bufferedConn, host string, port int) {
+	log.Printf("[%s] incoming SOCKS5 TCP/IP stream connection, raddr=%s", localConn.RemoteAddr(), net.JoinHostPort(host, strconv.Itoa(port)))
+
+	remoteConn, err := t.dial(host, port)
+	if err != nil {
+		log.Printf("[%s] unable to connect to remote host: %v", localConn.RemoteAddr(), err)
+		socks5Reply(localConn, socks5ErrorReply(err), nil)
+		return
+	}
+	defer remoteConn.Close()
+
+	socks5Reply(localConn, socks5Succeeded, remoteConn.LocalAddr())
+	pipe(localConn, remoteConn, t.shutdown)
+}
+
+// socks5Bind asks the server to listen for a single incoming connection on
+// behalf of the client, as used by protocols like active mode FTP. Like remote
+// forwards without GatewayPorts, the server only listens on loopback.
+func (t *DynamicTunnel) socks5Bind(localConn bufferedConn, host string, port int) {
+	log.Printf("[%s] incoming SOCKS5 BIND request, raddr=%s", localConn.RemoteAddr(), net.JoinHostPort(host, strconv.Itoa(port)))
+
+	listener, err := t.manager.client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("[%s] unable to listen on remote host: %v", localConn.RemoteAddr(), err)
+		socks5Reply(localConn, socks5ErrorReply(err), nil)
+		return
+	}
+	defer listener.Close()
+
+	socks5Reply(localConn, socks5Succeeded, listener.Addr())
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	// The client has nothing to say until the peer connects, so anything
+	// showing up other than early data means it has gone away
+	clientGone := make(chan struct{})
+	peeked := make(chan struct{})
+	go func() {
+		defer close(peeked)
+		if _, err := localConn.Peek(1); err != nil && !isTimeout(err) {
+			close(clientGone)
+		}
+	}()
+
+	var remoteConn net.Conn
+	select {
+	case remoteConn = <-accepted:
+	case <-clientGone:
+	case <-t.shutdown:
+	}
+
+	// Stop watching before the connection is piped
+	localConn.SetReadDeadline(time.Now())
+	<-peeked
+	localConn.SetReadDeadline(time.Time{})
+
+	if remoteConn == nil {
+		listener.Close()
+		if conn, ok := <-accepted; ok {
+			conn.Close()
+		}
+		socks5Reply(localConn, socks5GeneralFailure, nil)
+		return
+	}
+	defer remoteConn.Close()
+
+	socks5Reply(localConn, socks5Succeeded, remoteConn.RemoteAddr())
+	pipe(localConn, remoteConn, t.shutdown)
+}
+
+func isTimeout(err error) bool {
+	netErr, isa := err.(net.Error)
+	return isa && netErr.Timeout()
+}
+
+// readSocks5Addr reads an address type, address and port as found in SOCKS5
+// requests. Domain names are returned as is so they're resolved by the server.
+func readSocks5Addr(r io.Reader) (host string, port int, err error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", 0, err
+	}
+
+	var addr []byte
+	switch addrType[0] {
+	case socks5AddrIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		if host, err = readSocks5String(r); err != nil {
+			return "", 0, err
+		}
+	default:
+		return "", 0, errSocks5AddressType
+	}
+
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBytes); err != nil {
+		return "", 0, err
+	}
+
+	if addrType[0] != socks5AddrDomain {
+		host = net.IP(addr).String()
+	}
+
+	return host, int(binary.BigEndian.Uint16(portBytes)), nil
+}
+
+// socks5Reply writes a reply with the given status and bound address. An
+// unknown bound address is sent as 0.0.0.0:0.
+func socks5Reply(w io.Writer, status byte, bound net.Addr) {
+	ip, port := net.IPv4zero, 0
+	if addr, isa := bound.(*net.TCPAddr); isa && addr != nil && addr.IP != nil {
+		ip, port = addr.IP, addr.Port
+	}
+
+	reply := []byte{socks5Version, status, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(append(reply, socks5AddrIPv4), ip4...)
+	} else {
+		reply = append(append(reply, socks5AddrIPv6), ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port))
+
+	w.Write(reply)
+}
+
+// socks5ErrorReply maps errors from the ssh server to SOCKS5 reply codes.
+func socks5ErrorReply(err error) byte {
+	if err, isa := err.(*ssh.OpenChannelError); isa {
+		switch err.Reason {
+		case ssh.Prohibited:
+			return socks5NotAllowed
+		case ssh.ConnectionFailed:
+			if strings.Contains(err.Message, "refused") {
+				return socks5ConnectionRefused
+			}
+			return socks5HostUnreachable
+		}
+	}
+	return socks5GeneralFailure
+}
@@ -1,16 +1,33 @@
 package tunnels
 
 import (
-	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
 )
 
+// Endpoint is either a TCP host and port or, when Network is "unix", the Path
+// of a Unix socket. An empty Network is treated as "tcp".
 type Endpoint struct {
-	Host string
-	Port int
+	Network string
+	Host    string
+	Port    int
+	Path    string
+}
+
+func (endpoint Endpoint) network() string {
+	if endpoint.Network == "" {
+		return "tcp"
+	}
+	return endpoint.Network
 }
 
 func (endpoint Endpoint) String() string {
-	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	if endpoint.network() == "unix" {
+		return endpoint.Path
+	}
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
 }
 
 type Tunnel interface {
@@ -18,3 +35,59 @@ type Tunnel interface {
 	Close()
 	Name() string
 }
+
+// closer tears down a tunnel's listener exactly once, however many times and
+// from however many goroutines Close is called.
+type closer struct {
+	listener net.Listener
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+func newCloser(listener net.Listener) *closer {
+	return &closer{listener: listener, shutdown: make(chan struct{})}
+}
+
+// close stops the listener, signals shutdown to running connections and
+// unregisters tun from m.
+func (c *closer) close(m *Manager, tun Tunnel) {
+	c.once.Do(func() {
+		c.listener.Close()
+		close(c.shutdown)
+		m.unregister <- tun
+	})
+}
+
+// closeWriter is implemented by connections that can be half closed, such as
+// TCP and Unix connections and ssh channels.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data between a and b until both directions finish or shutdown
+// is closed. When one side stops sending the other is told with CloseWrite,
+// so a client that half closes after its request still gets the response.
+// Connections that can't be half closed end the pipe as soon as either
+// direction finishes.
+func pipe(a, b io.ReadWriter, shutdown <-chan struct{}) {
+	done := make(chan bool, 2)
+	copyConn := func(writer io.Writer, reader io.Reader) {
+		io.Copy(writer, reader)
+		cw, isa := writer.(closeWriter)
+		done <- isa && cw.CloseWrite() == nil
+	}
+
+	go copyConn(a, b)
+	go copyConn(b, a)
+
+	for remaining := 2; remaining > 0; remaining-- {
+		select {
+		case halfClosed := <-done:
+			if !halfClosed {
+				return
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package tunnels_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/freman/sshcode/tunnels"
+)
+
+// closeWriter is implemented by TCP and Unix connections.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfClose sends request on conn, closes its sending side and returns
+// everything that comes back.
+func halfClose(t *testing.T, conn net.Conn, request string) string {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	return string(response)
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	t.Parallel()
+
+	_, client := newTestServer(t)
+
+	mgr := tunnels.NewManager(client)
+	go mgr.Run()
+	t.Cleanup(mgr.Close)
+
+	fixed, err := mgr.Fixed("fixed",
+		tunnels.Endpoint{Host: "127.0.0.1"},
+		tunnels.Endpoint{Host: "halfclose.example", Port: 80},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dynamic, err := mgr.Dynamic("dynamic", tunnels.Endpoint{Host: "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("fixed", func(t *testing.T) {
+		conn := dialProxy(t, fixed.Local.String())
+		if response := halfClose(t, conn, "request"); response != "got request" {
+			t.Errorf("expected the whole response, got %q", response)
+		}
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := dialProxy(t, dynamic.Local.String())
+
+		conn.Write([]byte{5, 1, 0})
+		expect(t, conn, []byte{5, 0})
+		conn.Write(socks5Domain(1, "halfclose.example", 80))
+		if status, _ := readSocks5Reply(t, conn); status != 0 {
+			t.Fatalf("expected CONNECT to succeed, got %#x", status)
+		}
+
+		if response := halfClose(t, conn, "request"); response != "got request" {
+			t.Errorf("expected the whole response, got %q", response)
+		}
+	})
+}